@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/openaustralia/yinyo/pkg/apiserver"
 	"github.com/openaustralia/yinyo/pkg/commands"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
@@ -37,6 +39,14 @@ func durationStringToSeconds(durationString string) int64 {
 	return int64(duration.Seconds())
 }
 
+func cpuStringToMillicores(cpuString string) int64 {
+	cpu, err := resource.ParseQuantity(cpuString)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cpu.MilliValue()
+}
+
 func memoryStringToBytes(memoryString string) int64 {
 	memory, err := resource.ParseQuantity(memoryString)
 	if err != nil {
@@ -49,24 +59,66 @@ func memoryStringToBytes(memoryString string) int64 {
 var GitCommit = "development"
 
 func buildOptions() commands.StartupOptions {
-	var redisTLS bool
-	if os.Getenv("REDIS_TLS") == "true" {
-		redisTLS = true
+	// Use redis for the stream and the key value store unless we're told otherwise
+	streamBackend := os.Getenv("STREAM")
+	keyValueStoreBackend := os.Getenv("KEY_VALUE_STORE")
+	var redisOptions commands.RedisOptions
+	if streamBackend != "memory" || keyValueStoreBackend != "memory" {
+		var redisTLS bool
+		if os.Getenv("REDIS_TLS") == "true" {
+			redisTLS = true
+		}
+		redisOptions = commands.RedisOptions{
+			Address:  getMandatoryEnv("REDIS_HOST"),
+			Password: getMandatoryEnv("REDIS_PASSWORD"),
+			TLS:      redisTLS,
+			Database: getMandatoryEnvAsInt("REDIS_DATABASE"),
+		}
 	}
-	return commands.StartupOptions{
-		Minio: commands.MinioOptions{
+	// Use minio for the blob store unless we're told otherwise
+	blobStoreBackend := os.Getenv("BLOB_STORE")
+	var minioOptions commands.MinioOptions
+	var blobStoreDirectory string
+	if blobStoreBackend == "file" {
+		blobStoreDirectory = getMandatoryEnv("BLOB_STORE_DIR")
+	} else {
+		minioOptions = commands.MinioOptions{
 			Host:      getMandatoryEnv("STORE_HOST"),
 			Bucket:    getMandatoryEnv("STORE_BUCKET"),
 			AccessKey: getMandatoryEnv("STORE_ACCESS_KEY"),
 			SecretKey: getMandatoryEnv("STORE_SECRET_KEY"),
+		}
+	}
+	// Run jobs with Kubernetes unless we're told otherwise
+	jobDispatcher := os.Getenv("JOB_DISPATCHER")
+	var runsNamespace string
+	var scheduling jobdispatcher.Scheduling
+	if jobDispatcher == "" || jobDispatcher == "kubernetes" {
+		runsNamespace = getMandatoryEnv("RUNS_NAMESPACE")
+		// Optionally configure where and how the runs are scheduled with JSON
+		if s := os.Getenv("RUN_SCHEDULING"); s != "" {
+			err := json.Unmarshal([]byte(s), &scheduling)
+			if err != nil {
+				log.Fatalf("environment variable RUN_SCHEDULING needs to be valid JSON: %v", err)
+			}
+		}
+	}
+	return commands.StartupOptions{
+		BlobStore:          blobStoreBackend,
+		Minio:              minioOptions,
+		BlobStoreDirectory: blobStoreDirectory,
+		Redis:              redisOptions,
+		JobDispatcher:      jobDispatcher,
+		Local: commands.LocalOptions{
+			WrapperPath:  os.Getenv("LOCAL_WRAPPER_PATH"),
+			WorkDir:      os.Getenv("LOCAL_WORK_DIR"),
+			BuildCommand: os.Getenv("LOCAL_BUILD_COMMAND"),
+			RunCommand:   os.Getenv("LOCAL_RUN_COMMAND"),
 		},
-		Redis: commands.RedisOptions{
-			Address:  getMandatoryEnv("REDIS_HOST"),
-			Password: getMandatoryEnv("REDIS_PASSWORD"),
-			TLS:      redisTLS,
-			Database: getMandatoryEnvAsInt("REDIS_DATABASE"),
-		},
-		RunsNamespace:       getMandatoryEnv("RUNS_NAMESPACE"),
+		Scheduling:          scheduling,
+		Stream:              streamBackend,
+		KeyValueStore:       keyValueStoreBackend,
+		RunsNamespace:       runsNamespace,
 		AuthenticationURL:   os.Getenv("AUTHENTICATION_URL"),
 		ResourcesAllowedURL: os.Getenv("RESOURCES_ALLOWED_URL"),
 		UsageURL:            os.Getenv("USAGE_URL"),
@@ -78,7 +130,7 @@ func main() {
 	// Show the source of the error with the standard logger. Don't show date & time
 	log.SetFlags(log.Lshortfile)
 
-	var defaultMaxRunTimeString, maxRunTimeString, defaultMemoryString, maxMemoryString string
+	var defaultMaxRunTimeString, maxRunTimeString, defaultMemoryString, maxMemoryString, defaultCPUString, maxCPUString string
 
 	options := buildOptions()
 	// TODO: Why is runDockerImage not part of options?
@@ -95,6 +147,8 @@ func main() {
 				durationStringToSeconds(maxRunTimeString),
 				memoryStringToBytes(defaultMemoryString),
 				memoryStringToBytes(maxMemoryString),
+				cpuStringToMillicores(defaultCPUString),
+				cpuStringToMillicores(maxCPUString),
 				runDockerImage,
 				GitCommit,
 			)
@@ -111,6 +165,19 @@ func main() {
 	rootCmd.Flags().StringVar(&maxRunTimeString, "maxruntime", "24h", "Set the global maximum run time that all runs can not exceed")
 	rootCmd.Flags().StringVar(&defaultMemoryString, "defaultmemory", "0.75Gi", "Set the default memory that a run allocates if the user doesn't say")
 	rootCmd.Flags().StringVar(&maxMemoryString, "maxmemory", "1.5Gi", "Set the maximum memory that a run can allocate")
+	rootCmd.Flags().StringVar(&defaultCPUString, "defaultcpu", "1", "Set the default cpu that a run can use if the user doesn't say")
+	rootCmd.Flags().StringVar(&maxCPUString, "maxcpu", "2", "Set the maximum cpu that a run can use")
+	rootCmd.Flags().Int64Var(&options.MaxRuns, "maxruns", 0, "Set the maximum number of runs that can go at the same time. Others wait in a queue. 0 means no limit")
+	rootCmd.Flags().Int64Var(&options.MaxRunsPerAPIKey, "maxrunsperapikey", 0, "Set the maximum number of runs that can go at the same time for each API key. Others wait in a queue. 0 means no limit")
+	rootCmd.Flags().DurationVar(&options.DispatchInterval, "dispatchinterval", time.Minute, "Set how often to check for queued runs that could have been started but weren't. 0 means only when a run finishes")
+	rootCmd.Flags().Int64Var(&options.EventsBatchSize, "eventsbatchsize", 100, "Set the number of events that are read from the stream at a time")
+	rootCmd.Flags().BoolVar(&options.CompressEvents, "compressevents", false, "Gzip the events of a run when they are archived to the blob store")
+	rootCmd.Flags().DurationVar(&options.Reaper.Interval, "reapinterval", 0, "Set how often to look for abandoned runs to delete. 0 means never")
+	rootCmd.Flags().DurationVar(&options.Reaper.NotStartedTTL, "reapnotstarted", 0, "Delete runs that were never started after this long. 0 means never")
+	rootCmd.Flags().DurationVar(&options.Reaper.FinishedTTL, "reapfinished", 0, "Delete runs that have finished but were never deleted after this long. 0 means never")
+	rootCmd.Flags().DurationVar(&options.Reaper.RunningTTL, "reaprunning", 0, "Delete runs that are still going when nothing has happened to them for this long. 0 means never")
+	rootCmd.Flags().DurationVar(&options.RetryInterval, "retryinterval", time.Minute, "Set how often to try again at things that didn't work the first time, like archiving events or deleting runs. 0 means never")
+	rootCmd.Flags().DurationVar(&options.PresignExpiry, "presignexpiry", 0, "Redirect clients to get and put the app, cache and output directly from minio with presigned URLs that last this long. 0 means everything goes through the server")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
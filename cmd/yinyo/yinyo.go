@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/openaustralia/yinyo/pkg/apiclient"
 	"github.com/openaustralia/yinyo/pkg/protocol"
@@ -123,7 +127,7 @@ func getAPIKey(clientServerURL string) (string, error) {
 	return apiKey, nil
 }
 
-func createRun(clientServerURL string) (apiclient.RunInterface, error) {
+func createRun(clientServerURL string, labels map[string]string) (apiclient.RunInterface, error) {
 	var run apiclient.RunInterface
 	apiKey, err := getAPIKey(clientServerURL)
 	if err != nil {
@@ -132,7 +136,7 @@ func createRun(clientServerURL string) (apiclient.RunInterface, error) {
 	client := apiclient.New(clientServerURL)
 	for {
 		// Create the run
-		run, err = client.CreateRun(protocol.CreateRunOptions{APIKey: apiKey})
+		run, err = client.CreateRun(protocol.CreateRunOptions{APIKey: apiKey, Labels: labels})
 		if err == nil {
 			return run, err
 		}
@@ -149,6 +153,37 @@ func createRun(clientServerURL string) (apiclient.RunInterface, error) {
 	}
 }
 
+// listRuns shows all the runs one line per run, getting them a page at a time
+func listRuns(client *apiclient.Client, options apiclient.ListRunsOptions) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tPHASE\tEXIT CODE")
+	for {
+		page, err := client.ListRuns(options)
+		if err != nil {
+			return err
+		}
+		for _, run := range page.Runs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", run.ID, run.CreatedAt.Local().Format(time.RFC3339), run.Phase, exitCode(run.ExitData))
+		}
+		if !page.More {
+			break
+		}
+		options.Cursor = page.Cursor
+	}
+	return w.Flush()
+}
+
+// exitCode is the exit code of the last stage that finished or nothing if none have
+func exitCode(exitData protocol.ExitData) string {
+	if exitData.Execute != nil {
+		return strconv.Itoa(exitData.Execute.ExitCode)
+	}
+	if exitData.Build != nil {
+		return strconv.Itoa(exitData.Build.ExitCode)
+	}
+	return ""
+}
+
 // reconnectCommand returns the command to reconnect to the current run
 func reconnectCommand(cmd *cobra.Command, runID string, scraperDirectory string) string {
 	// We're hacking together the command-line rendering here. I hope there's a more sensible way of doing this with cobra.
@@ -192,7 +227,7 @@ func main() {
 
 	var callbackURL, outputFile, clientServerURL, runID string
 	var showEventsJSON, cache, disableProgress bool
-	var environment map[string]string
+	var environment, labels map[string]string
 
 	var rootCmd = &cobra.Command{
 		Use:   "yinyo scraper_directory",
@@ -203,7 +238,7 @@ func main() {
 			eventCallback := func(event protocol.Event) error { return display(event, showEventsJSON) }
 
 			if runID == "" {
-				run, err := createRun(clientServerURL)
+				run, err := createRun(clientServerURL, labels)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -233,12 +268,57 @@ func main() {
 		},
 	}
 
+	var logsOptions apiclient.LogsOptions
+	var logsCmd = &cobra.Command{
+		Use:   "logs run_id",
+		Short: "Show the logs of a run so far as plain text",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run := &apiclient.Run{Client: apiclient.New(clientServerURL), Run: protocol.Run{ID: args[0]}}
+			logs, err := run.GetLogs(logsOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer logs.Close()
+			_, err = io.Copy(os.Stdout, logs)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	logsCmd.Flags().StringSliceVar(&logsOptions.Stages, "stage", []string{}, "Only show the logs from these stages (build or execute)")
+	logsCmd.Flags().StringSliceVar(&logsOptions.Streams, "stream", []string{}, "Only show the logs from these streams (stdout, stderr or interr)")
+	logsCmd.Flags().BoolVar(&logsOptions.Timestamps, "timestamps", false, "Show when each line was logged")
+	logsCmd.Flags().BoolVar(&logsOptions.Prefixes, "prefixes", false, "Show the stage and stream that each line came from")
+	rootCmd.AddCommand(logsCmd)
+
+	var listOptions apiclient.ListRunsOptions
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List your runs that haven't been deleted",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			apiKey, err := getAPIKey(clientServerURL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listOptions.APIKey = apiKey
+			err = listRuns(apiclient.New(clientServerURL), listOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	listCmd.Flags().StringSliceVar(&listOptions.Phases, "phase", []string{}, "Only list runs in these phases (created, app_uploaded, started, finished or deleting)")
+	rootCmd.AddCommand(listCmd)
+
+	rootCmd.PersistentFlags().StringVar(&clientServerURL, "server", "https://api.yinyo.io", "Override yinyo server URL")
 	rootCmd.Flags().StringVar(&callbackURL, "callback", "", "Optionally provide a callback URL. For every event a POST to the URL will be made. To be able to authenticate the callback you'll need to specify a secret in the URL. Something like http://my-url-endpoint.com?key=special-secret-stuff would do the trick")
 	// TODO: Check that the output file is a relative path and if not error
 	rootCmd.Flags().StringVar(&outputFile, "output", "", "The output is written to the same local directory at the end. The output file path is given relative to the scraper directory")
 	rootCmd.Flags().StringVar(&runID, "connect", "", "Connect to a run that has already started by giving the run ID")
-	rootCmd.Flags().StringVar(&clientServerURL, "server", "https://api.yinyo.io", "Override yinyo server URL")
 	rootCmd.Flags().StringToStringVar(&environment, "env", map[string]string{}, "Set one or more environment variables (e.g. --env foo=twiddle,bar=blah)")
+	rootCmd.Flags().StringToStringVar(&labels, "label", map[string]string{}, "Attach one or more labels to the run which are included in callbacks and when listing runs (e.g. --label scraper=planningalerts)")
 	rootCmd.Flags().BoolVar(&showEventsJSON, "allevents", false, "Show the full events output as JSON instead of the default of just showing the log events as text")
 	rootCmd.Flags().BoolVar(&cache, "cache", false, "Enable the download and upload of the build cache")
 	rootCmd.Flags().BoolVar(&disableProgress, "noprogress", false, "Disable messages showing progress")
@@ -11,6 +11,7 @@ require (
 	github.com/go-redis/redis v6.15.5+incompatible
 	github.com/golangci/golangci-lint v1.23.6 // indirect
 	github.com/gorilla/mux v1.7.3
+	github.com/gorilla/websocket v1.4.2
 	github.com/hashicorp/go-retryablehttp v0.6.4
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	github.com/minio/minio-go/v6 v6.0.33
@@ -12,6 +12,20 @@ type RunInterface struct {
 	mock.Mock
 }
 
+// Cancel provides a mock function with given fields:
+func (_m *RunInterface) Cancel() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CreateEvent provides a mock function with given fields: event
 func (_m *RunInterface) CreateEvent(event protocol.Event) (int, error) {
 	ret := _m.Called(event)
@@ -240,13 +254,13 @@ func (_m *RunInterface) GetCacheToFile(path string) error {
 	return r0
 }
 
-// GetEvents provides a mock function with given fields: lastID
-func (_m *RunInterface) GetEvents(lastID string) (*apiclient.EventIterator, error) {
-	ret := _m.Called(lastID)
+// GetEvents provides a mock function with given fields: lastID, filter
+func (_m *RunInterface) GetEvents(lastID string, filter protocol.EventFilter) (*apiclient.EventIterator, error) {
+	ret := _m.Called(lastID, filter)
 
 	var r0 *apiclient.EventIterator
-	if rf, ok := ret.Get(0).(func(string) *apiclient.EventIterator); ok {
-		r0 = rf(lastID)
+	if rf, ok := ret.Get(0).(func(string, protocol.EventFilter) *apiclient.EventIterator); ok {
+		r0 = rf(lastID, filter)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*apiclient.EventIterator)
@@ -254,8 +268,29 @@ func (_m *RunInterface) GetEvents(lastID string) (*apiclient.EventIterator, erro
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(lastID)
+	if rf, ok := ret.Get(1).(func(string, protocol.EventFilter) error); ok {
+		r1 = rf(lastID, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetEventsPage provides a mock function with given fields: lastID, filter, limit
+func (_m *RunInterface) GetEventsPage(lastID string, filter protocol.EventFilter, limit int) (protocol.EventsPage, error) {
+	ret := _m.Called(lastID, filter, limit)
+
+	var r0 protocol.EventsPage
+	if rf, ok := ret.Get(0).(func(string, protocol.EventFilter, int) protocol.EventsPage); ok {
+		r0 = rf(lastID, filter, limit)
+	} else {
+		r0 = ret.Get(0).(protocol.EventsPage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, protocol.EventFilter, int) error); ok {
+		r1 = rf(lastID, filter, limit)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -298,6 +333,29 @@ func (_m *RunInterface) GetID() string {
 	return r0
 }
 
+// GetLogs provides a mock function with given fields: options
+func (_m *RunInterface) GetLogs(options apiclient.LogsOptions) (io.ReadCloser, error) {
+	ret := _m.Called(options)
+
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(apiclient.LogsOptions) io.ReadCloser); ok {
+		r0 = rf(options)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(apiclient.LogsOptions) error); ok {
+		r1 = rf(options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetOutput provides a mock function with given fields:
 func (_m *RunInterface) GetOutput() (io.ReadCloser, error) {
 	ret := _m.Called()
@@ -335,6 +393,27 @@ func (_m *RunInterface) GetOutputToFile(path string) error {
 	return r0
 }
 
+// GetStatus provides a mock function with given fields:
+func (_m *RunInterface) GetStatus() (protocol.RunStatus, error) {
+	ret := _m.Called()
+
+	var r0 protocol.RunStatus
+	if rf, ok := ret.Get(0).(func() protocol.RunStatus); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(protocol.RunStatus)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PutApp provides a mock function with given fields: data
 func (_m *RunInterface) PutApp(data io.Reader) error {
 	ret := _m.Called(data)
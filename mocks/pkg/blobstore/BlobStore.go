@@ -3,6 +3,8 @@
 package mocks
 
 import io "io"
+import time "time"
+import url "net/url"
 import mock "github.com/stretchr/testify/mock"
 
 // BlobStore is an autogenerated mock type for the BlobStore type
@@ -25,15 +27,15 @@ func (_m *BlobStore) Delete(path string) error {
 }
 
 // Get provides a mock function with given fields: path
-func (_m *BlobStore) Get(path string) (io.Reader, error) {
+func (_m *BlobStore) Get(path string) (io.ReadCloser, error) {
 	ret := _m.Called(path)
 
-	var r0 io.Reader
-	if rf, ok := ret.Get(0).(func(string) io.Reader); ok {
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(string) io.ReadCloser); ok {
 		r0 = rf(path)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(io.Reader)
+			r0 = ret.Get(0).(io.ReadCloser)
 		}
 	}
 
@@ -61,6 +63,52 @@ func (_m *BlobStore) IsNotExist(_a0 error) bool {
 	return r0
 }
 
+// PresignedGetURL provides a mock function with given fields: path, expiry
+func (_m *BlobStore) PresignedGetURL(path string, expiry time.Duration) (*url.URL, error) {
+	ret := _m.Called(path, expiry)
+
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string, time.Duration) *url.URL); ok {
+		r0 = rf(path, expiry)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*url.URL)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, time.Duration) error); ok {
+		r1 = rf(path, expiry)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PresignedPutURL provides a mock function with given fields: path, expiry
+func (_m *BlobStore) PresignedPutURL(path string, expiry time.Duration) (*url.URL, error) {
+	ret := _m.Called(path, expiry)
+
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string, time.Duration) *url.URL); ok {
+		r0 = rf(path, expiry)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*url.URL)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, time.Duration) error); ok {
+		r1 = rf(path, expiry)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Put provides a mock function with given fields: path, reader, objectSize
 func (_m *BlobStore) Put(path string, reader io.Reader, objectSize int64) error {
 	ret := _m.Called(path, reader, objectSize)
@@ -6,12 +6,27 @@ import commands "github.com/openaustralia/yinyo/pkg/commands"
 import io "io"
 import mock "github.com/stretchr/testify/mock"
 import protocol "github.com/openaustralia/yinyo/pkg/protocol"
+import url "net/url"
 
 // App is an autogenerated mock type for the App type
 type App struct {
 	mock.Mock
 }
 
+// CancelRun provides a mock function with given fields: runID
+func (_m *App) CancelRun(runID string) error {
+	ret := _m.Called(runID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(runID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CreateEvent provides a mock function with given fields: runID, event
 func (_m *App) CreateEvent(runID string, event protocol.Event) error {
 	ret := _m.Called(runID, event)
@@ -62,15 +77,38 @@ func (_m *App) DeleteRun(runID string) error {
 }
 
 // GetApp provides a mock function with given fields: runID
-func (_m *App) GetApp(runID string) (io.Reader, error) {
+func (_m *App) GetApp(runID string) (io.ReadCloser, error) {
+	ret := _m.Called(runID)
+
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(string) io.ReadCloser); ok {
+		r0 = rf(runID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetAppURL provides a mock function with given fields: runID
+func (_m *App) GetAppURL(runID string) (*url.URL, error) {
 	ret := _m.Called(runID)
 
-	var r0 io.Reader
-	if rf, ok := ret.Get(0).(func(string) io.Reader); ok {
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string) *url.URL); ok {
 		r0 = rf(runID)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(io.Reader)
+			r0 = ret.Get(0).(*url.URL)
 		}
 	}
 
@@ -85,15 +123,38 @@ func (_m *App) GetApp(runID string) (io.Reader, error) {
 }
 
 // GetCache provides a mock function with given fields: runID
-func (_m *App) GetCache(runID string) (io.Reader, error) {
+func (_m *App) GetCache(runID string) (io.ReadCloser, error) {
+	ret := _m.Called(runID)
+
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(string) io.ReadCloser); ok {
+		r0 = rf(runID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetCacheURL provides a mock function with given fields: runID
+func (_m *App) GetCacheURL(runID string) (*url.URL, error) {
 	ret := _m.Called(runID)
 
-	var r0 io.Reader
-	if rf, ok := ret.Get(0).(func(string) io.Reader); ok {
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string) *url.URL); ok {
 		r0 = rf(runID)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(io.Reader)
+			r0 = ret.Get(0).(*url.URL)
 		}
 	}
 
@@ -107,13 +168,13 @@ func (_m *App) GetCache(runID string) (io.Reader, error) {
 	return r0, r1
 }
 
-// GetEvents provides a mock function with given fields: runID, lastID
-func (_m *App) GetEvents(runID string, lastID string) commands.EventIterator {
-	ret := _m.Called(runID, lastID)
+// GetEvents provides a mock function with given fields: runID, options
+func (_m *App) GetEvents(runID string, options commands.EventsOptions) commands.EventIterator {
+	ret := _m.Called(runID, options)
 
 	var r0 commands.EventIterator
-	if rf, ok := ret.Get(0).(func(string, string) commands.EventIterator); ok {
-		r0 = rf(runID, lastID)
+	if rf, ok := ret.Get(0).(func(string, commands.EventsOptions) commands.EventIterator); ok {
+		r0 = rf(runID, options)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(commands.EventIterator)
@@ -145,15 +206,38 @@ func (_m *App) GetExitData(runID string) (protocol.ExitData, error) {
 }
 
 // GetOutput provides a mock function with given fields: runID
-func (_m *App) GetOutput(runID string) (io.Reader, error) {
+func (_m *App) GetOutput(runID string) (io.ReadCloser, error) {
+	ret := _m.Called(runID)
+
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(string) io.ReadCloser); ok {
+		r0 = rf(runID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetOutputURL provides a mock function with given fields: runID
+func (_m *App) GetOutputURL(runID string) (*url.URL, error) {
 	ret := _m.Called(runID)
 
-	var r0 io.Reader
-	if rf, ok := ret.Get(0).(func(string) io.Reader); ok {
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string) *url.URL); ok {
 		r0 = rf(runID)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(io.Reader)
+			r0 = ret.Get(0).(*url.URL)
 		}
 	}
 
@@ -167,6 +251,27 @@ func (_m *App) GetOutput(runID string) (io.Reader, error) {
 	return r0, r1
 }
 
+// GetStatus provides a mock function with given fields: runID
+func (_m *App) GetStatus(runID string) (protocol.RunStatus, error) {
+	ret := _m.Called(runID)
+
+	var r0 protocol.RunStatus
+	if rf, ok := ret.Get(0).(func(string) protocol.RunStatus); ok {
+		r0 = rf(runID)
+	} else {
+		r0 = ret.Get(0).(protocol.RunStatus)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // IsRunCreated provides a mock function with given fields: runID
 func (_m *App) IsRunCreated(runID string) (bool, error) {
 	ret := _m.Called(runID)
@@ -188,6 +293,27 @@ func (_m *App) IsRunCreated(runID string) (bool, error) {
 	return r0, r1
 }
 
+// ListRuns provides a mock function with given fields: options
+func (_m *App) ListRuns(options commands.ListRunsOptions) (protocol.RunsPage, error) {
+	ret := _m.Called(options)
+
+	var r0 protocol.RunsPage
+	if rf, ok := ret.Get(0).(func(commands.ListRunsOptions) protocol.RunsPage); ok {
+		r0 = rf(options)
+	} else {
+		r0 = ret.Get(0).(protocol.RunsPage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(commands.ListRunsOptions) error); ok {
+		r1 = rf(options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PutApp provides a mock function with given fields: runID, reader, objectSize
 func (_m *App) PutApp(runID string, reader io.Reader, objectSize int64) error {
 	ret := _m.Called(runID, reader, objectSize)
@@ -202,6 +328,29 @@ func (_m *App) PutApp(runID string, reader io.Reader, objectSize int64) error {
 	return r0
 }
 
+// PutAppURL provides a mock function with given fields: runID
+func (_m *App) PutAppURL(runID string) (*url.URL, error) {
+	ret := _m.Called(runID)
+
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string) *url.URL); ok {
+		r0 = rf(runID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*url.URL)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PutCache provides a mock function with given fields: runID, reader, objectSize
 func (_m *App) PutCache(runID string, reader io.Reader, objectSize int64) error {
 	ret := _m.Called(runID, reader, objectSize)
@@ -216,6 +365,29 @@ func (_m *App) PutCache(runID string, reader io.Reader, objectSize int64) error
 	return r0
 }
 
+// PutCacheURL provides a mock function with given fields: runID
+func (_m *App) PutCacheURL(runID string) (*url.URL, error) {
+	ret := _m.Called(runID)
+
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string) *url.URL); ok {
+		r0 = rf(runID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*url.URL)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PutOutput provides a mock function with given fields: runID, reader, objectSize
 func (_m *App) PutOutput(runID string, reader io.Reader, objectSize int64) error {
 	ret := _m.Called(runID, reader, objectSize)
@@ -230,6 +402,29 @@ func (_m *App) PutOutput(runID string, reader io.Reader, objectSize int64) error
 	return r0
 }
 
+// PutOutputURL provides a mock function with given fields: runID
+func (_m *App) PutOutputURL(runID string) (*url.URL, error) {
+	ret := _m.Called(runID)
+
+	var r0 *url.URL
+	if rf, ok := ret.Get(0).(func(string) *url.URL); ok {
+		r0 = rf(runID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*url.URL)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ReportAPINetworkUsage provides a mock function with given fields: runID, in, out
 func (_m *App) ReportAPINetworkUsage(runID string, in uint64, out uint64) error {
 	ret := _m.Called(runID, in, out)
@@ -2,6 +2,7 @@
 
 package mocks
 
+import context "context"
 import mock "github.com/stretchr/testify/mock"
 import protocol "github.com/openaustralia/yinyo/pkg/protocol"
 
@@ -10,6 +11,20 @@ type EventIterator struct {
 	mock.Mock
 }
 
+// Close provides a mock function with given fields:
+func (_m *EventIterator) Close() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // More provides a mock function with given fields:
 func (_m *EventIterator) More() bool {
 	ret := _m.Called()
@@ -24,20 +39,20 @@ func (_m *EventIterator) More() bool {
 	return r0
 }
 
-// Next provides a mock function with given fields:
-func (_m *EventIterator) Next() (protocol.Event, error) {
-	ret := _m.Called()
+// Next provides a mock function with given fields: ctx
+func (_m *EventIterator) Next(ctx context.Context) (protocol.Event, error) {
+	ret := _m.Called(ctx)
 
 	var r0 protocol.Event
-	if rf, ok := ret.Get(0).(func() protocol.Event); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) protocol.Event); ok {
+		r0 = rf(ctx)
 	} else {
 		r0 = ret.Get(0).(protocol.Event)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
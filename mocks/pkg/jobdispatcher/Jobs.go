@@ -2,6 +2,7 @@
 
 package mocks
 
+import jobdispatcher "github.com/openaustralia/yinyo/pkg/jobdispatcher"
 import mock "github.com/stretchr/testify/mock"
 
 // Jobs is an autogenerated mock type for the Jobs type
@@ -9,13 +10,27 @@ type Jobs struct {
 	mock.Mock
 }
 
-// Create provides a mock function with given fields: runID, dockerImage, command, maxRunTime, memory
-func (_m *Jobs) Create(runID string, dockerImage string, command []string, maxRunTime int64, memory int64) error {
-	ret := _m.Called(runID, dockerImage, command, maxRunTime, memory)
+// CheckScheduling provides a mock function with given fields: scheduling
+func (_m *Jobs) CheckScheduling(scheduling jobdispatcher.RunScheduling) error {
+	ret := _m.Called(scheduling)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, []string, int64, int64) error); ok {
-		r0 = rf(runID, dockerImage, command, maxRunTime, memory)
+	if rf, ok := ret.Get(0).(func(jobdispatcher.RunScheduling) error); ok {
+		r0 = rf(scheduling)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Create provides a mock function with given fields: runID, options
+func (_m *Jobs) Create(runID string, options jobdispatcher.CreateOptions) error {
+	ret := _m.Called(runID, options)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, jobdispatcher.CreateOptions) error); ok {
+		r0 = rf(runID, options)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -36,3 +51,38 @@ func (_m *Jobs) Delete(runID string) error {
 
 	return r0
 }
+
+// GetStatus provides a mock function with given fields: runID
+func (_m *Jobs) GetStatus(runID string) (jobdispatcher.Status, error) {
+	ret := _m.Called(runID)
+
+	var r0 jobdispatcher.Status
+	if rf, ok := ret.Get(0).(func(string) jobdispatcher.Status); ok {
+		r0 = rf(runID)
+	} else {
+		r0 = ret.Get(0).(jobdispatcher.Status)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(runID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Watch provides a mock function with given fields: handler
+func (_m *Jobs) Watch(handler jobdispatcher.WatchHandler) error {
+	ret := _m.Called(handler)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(jobdispatcher.WatchHandler) error); ok {
+		r0 = rf(handler)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
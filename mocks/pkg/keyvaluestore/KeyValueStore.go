@@ -2,6 +2,7 @@
 
 package mocks
 
+import keyvaluestore "github.com/openaustralia/yinyo/pkg/keyvaluestore"
 import mock "github.com/stretchr/testify/mock"
 
 // KeyValueStore is an autogenerated mock type for the KeyValueStore type
@@ -9,6 +10,27 @@ type KeyValueStore struct {
 	mock.Mock
 }
 
+// CompareAndSet provides a mock function with given fields: key, old, value
+func (_m *KeyValueStore) CompareAndSet(key string, old string, value string) (bool, error) {
+	ret := _m.Called(key, old, value)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, string, string) bool); ok {
+		r0 = rf(key, old, value)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
+		r1 = rf(key, old, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Delete provides a mock function with given fields: key
 func (_m *KeyValueStore) Delete(key string) error {
 	ret := _m.Called(key)
@@ -44,6 +66,104 @@ func (_m *KeyValueStore) Get(key string) (string, error) {
 	return r0, r1
 }
 
+// GetAndDelete provides a mock function with given fields: key
+func (_m *KeyValueStore) GetAndDelete(key string) (string, error) {
+	ret := _m.Called(key)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Increment provides a mock function with given fields: key, value
+func (_m *KeyValueStore) Increment(key string, value int64) (int64, error) {
+	ret := _m.Called(key, value)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, int64) int64); ok {
+		r0 = rf(key, value)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int64) error); ok {
+		r1 = rf(key, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListLength provides a mock function with given fields: key
+func (_m *KeyValueStore) ListLength(key string) (int64, error) {
+	ret := _m.Called(key)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string) int64); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListPop provides a mock function with given fields: key
+func (_m *KeyValueStore) ListPop(key string) (string, error) {
+	ret := _m.Called(key)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListPush provides a mock function with given fields: key, value
+func (_m *KeyValueStore) ListPush(key string, value string) error {
+	ret := _m.Called(key, value)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string) error); ok {
+		r0 = rf(key, value)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Set provides a mock function with given fields: key, value
 func (_m *KeyValueStore) Set(key string, value string) error {
 	ret := _m.Called(key, value)
@@ -57,3 +177,75 @@ func (_m *KeyValueStore) Set(key string, value string) error {
 
 	return r0
 }
+
+// SetIfNotExists provides a mock function with given fields: key, value
+func (_m *KeyValueStore) SetIfNotExists(key string, value string) (bool, error) {
+	ret := _m.Called(key, value)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, string) bool); ok {
+		r0 = rf(key, value)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(key, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SortedSetAdd provides a mock function with given fields: key, value, score
+func (_m *KeyValueStore) SortedSetAdd(key string, value string, score int64) error {
+	ret := _m.Called(key, value, score)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, int64) error); ok {
+		r0 = rf(key, value, score)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SortedSetRangeAfter provides a mock function with given fields: key, after, count
+func (_m *KeyValueStore) SortedSetRangeAfter(key string, after int64, count int64) ([]keyvaluestore.ScoredValue, error) {
+	ret := _m.Called(key, after, count)
+
+	var r0 []keyvaluestore.ScoredValue
+	if rf, ok := ret.Get(0).(func(string, int64, int64) []keyvaluestore.ScoredValue); ok {
+		r0 = rf(key, after, count)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]keyvaluestore.ScoredValue)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int64, int64) error); ok {
+		r1 = rf(key, after, count)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SortedSetRemove provides a mock function with given fields: key, value
+func (_m *KeyValueStore) SortedSetRemove(key string, value string) error {
+	ret := _m.Called(key, value)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string) error); ok {
+		r0 = rf(key, value)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
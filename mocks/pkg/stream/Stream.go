@@ -2,8 +2,10 @@
 
 package mocks
 
+import context "context"
 import mock "github.com/stretchr/testify/mock"
 import protocol "github.com/openaustralia/yinyo/pkg/protocol"
+import time "time"
 
 // Stream is an autogenerated mock type for the Stream type
 type Stream struct {
@@ -45,20 +47,57 @@ func (_m *Stream) Delete(key string) error {
 	return r0
 }
 
-// Get provides a mock function with given fields: key, id
-func (_m *Stream) Get(key string, id string) (protocol.Event, error) {
-	ret := _m.Called(key, id)
+// Expire provides a mock function with given fields: key, after
+func (_m *Stream) Expire(key string, after time.Duration) error {
+	ret := _m.Called(key, after)
 
-	var r0 protocol.Event
-	if rf, ok := ret.Get(0).(func(string, string) protocol.Event); ok {
-		r0 = rf(key, id)
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, time.Duration) error); ok {
+		r0 = rf(key, after)
 	} else {
-		r0 = ret.Get(0).(protocol.Event)
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Get provides a mock function with given fields: ctx, key, id, count
+func (_m *Stream) Get(ctx context.Context, key string, id string, count int64) ([]protocol.Event, error) {
+	ret := _m.Called(ctx, key, id, count)
+
+	var r0 []protocol.Event
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int64) []protocol.Event); ok {
+		r0 = rf(ctx, key, id, count)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]protocol.Event)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int64) error); ok {
+		r1 = rf(ctx, key, id, count)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// LastID provides a mock function with given fields: key
+func (_m *Stream) LastID(key string) (string, error) {
+	ret := _m.Called(key)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(string)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(key, id)
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 
 	"github.com/openaustralia/yinyo/pkg/protocol"
 )
@@ -26,11 +29,15 @@ type RunInterface interface {
 	GetCache() (io.ReadCloser, error)
 	GetOutput() (io.ReadCloser, error)
 	GetExitData() (exitData protocol.ExitData, err error)
+	GetStatus() (status protocol.RunStatus, err error)
 	PutApp(data io.Reader) error
 	PutCache(data io.Reader) error
 	PutOutput(data io.Reader) error
 	Start(options *protocol.StartRunOptions) error
-	GetEvents(lastID string) (*EventIterator, error)
+	Cancel() error
+	GetEvents(lastID string, filter protocol.EventFilter) (*EventIterator, error)
+	GetEventsPage(lastID string, filter protocol.EventFilter, limit int) (protocol.EventsPage, error)
+	GetLogs(options LogsOptions) (io.ReadCloser, error)
 	CreateEvent(event protocol.Event) (int, error)
 	Delete() error
 	// The following methods operate on to top of the lower level methods above
@@ -136,7 +143,16 @@ func (client *Client) CreateRun(options protocol.CreateRunOptions) (RunInterface
 		v.Add("api_key", options.APIKey)
 		uri = uri + "?" + v.Encode()
 	}
-	req, err := http.NewRequest("POST", uri, nil)
+	// Only send a body if there's something in it
+	var body io.Reader
+	if len(options.Labels) > 0 {
+		b, err := json.Marshal(options)
+		if err != nil {
+			return run, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest("POST", uri, body)
 	if err != nil {
 		return run, err
 	}
@@ -157,6 +173,53 @@ func (client *Client) CreateRun(options protocol.CreateRunOptions) (RunInterface
 	return run, err
 }
 
+// ListRunsOptions control which runs ListRuns returns
+type ListRunsOptions struct {
+	// The runs that were created with this API key are listed
+	APIKey string
+	// Only include runs in these phases. Empty means all of them
+	Phases []string
+	// Where to carry on from. Use the cursor from the previous page. Empty starts at the beginning.
+	Cursor string
+	// The maximum number of runs to return. 0 means the server's default
+	Limit int
+}
+
+// ListRuns returns a page of runs in the order they were created
+func (client *Client) ListRuns(options ListRunsOptions) (protocol.RunsPage, error) {
+	var page protocol.RunsPage
+	q := url.Values{}
+	if options.APIKey != "" {
+		q.Add("api_key", options.APIKey)
+	}
+	for _, p := range options.Phases {
+		q.Add("phase", p)
+	}
+	if options.Cursor != "" {
+		q.Add("cursor", options.Cursor)
+	}
+	if options.Limit != 0 {
+		q.Add("limit", strconv.Itoa(options.Limit))
+	}
+	req, err := http.NewRequest("GET", client.URL+"/runs?"+q.Encode(), nil)
+	if err != nil {
+		return page, err
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+	if err = checkOK(resp); err != nil {
+		return page, err
+	}
+	if err = checkContentType(resp, "application/json"); err != nil {
+		return page, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
 // GetID returns the name of the run
 func (run *Run) GetID() string {
 	return run.ID
@@ -199,31 +262,150 @@ func (run *Run) GetOutput() (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
-// PutApp uploads the tarred & gzipped scraper code
-func (run *Run) PutApp(appData io.Reader) error {
-	resp, err := run.request("PUT", "/app", appData)
+// upload is data to be uploaded whose size we know and which can be sent again from the start
+type upload struct {
+	data  io.ReadSeeker
+	start int64
+	size  int64
+	// If the data had to be written to a temporary file first this is it
+	tmpfile *os.File
+}
+
+// newUpload works out the size of data and where it starts. Only if that can't be done,
+// because the data is being streamed, is it written to a temporary file first. Call close
+// when finished with it.
+func newUpload(data io.Reader) (*upload, error) {
+	if seeker, ok := data.(io.ReadSeeker); ok {
+		u, err := seekableUpload(seeker)
+		// Some things, like pipes, look like they can seek but can't
+		if err == nil {
+			return u, nil
+		}
+	}
+	tmpfile, err := ioutil.TempFile("", "yinyo-upload")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return checkOK(resp)
+	u := &upload{data: tmpfile, tmpfile: tmpfile}
+	u.size, err = io.Copy(tmpfile, data)
+	if err == nil {
+		err = u.rewind()
+	}
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	return u, nil
 }
 
-// PutCache uploads the tarred & gzipped build cache
-func (run *Run) PutCache(data io.Reader) error {
-	resp, err := run.request("PUT", "/cache", data)
+func seekableUpload(seeker io.ReadSeeker) (*upload, error) {
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = seeker.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return &upload{data: seeker, start: start, size: end - start}, nil
+}
+
+// body returns something to use as the body of a request. It stops the data from being
+// closed when the request is done with it.
+func (u *upload) body() io.Reader {
+	// Otherwise the size would be treated as unknown
+	if u.size == 0 {
+		return http.NoBody
+	}
+	return io.LimitReader(u.data, u.size)
+}
+
+// rewind goes back to the start so that the data can be sent again
+func (u *upload) rewind() error {
+	_, err := u.data.Seek(u.start, io.SeekStart)
+	return err
+}
+
+func (u *upload) close() {
+	if u.tmpfile != nil {
+		u.tmpfile.Close()
+		os.Remove(u.tmpfile.Name())
+	}
+}
+
+// put uploads a file. The server might redirect us to upload it directly to the blob store
+// instead. Because of the "Expect: 100-continue" it normally does that before any of it is
+// sent. If the client gets tired of waiting and starts sending anyway we go back to the start
+// and send it again.
+func (run *Run) put(path string, data io.Reader, contentType string) error {
+	u, err := newUpload(data)
 	if err != nil {
 		return err
 	}
-	return checkOK(resp)
+	defer u.close()
+	req, err := http.NewRequest("PUT", run.Client.URL+fmt.Sprintf("/runs/%s", run.ID)+path, u.body())
+	if err != nil {
+		return err
+	}
+	req.ContentLength = u.size
+	req.Header.Set("Expect", "100-continue")
+	resp, err := run.Client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		return checkOK(resp)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return err
+	}
+	err = u.rewind()
+	if err != nil {
+		return err
+	}
+	return putToBlobStore(run.Client.HTTPClient, location, u, contentType)
 }
 
-// PutOutput uploads the output of the scraper
-func (run *Run) PutOutput(data io.Reader) error {
-	resp, err := run.request("PUT", "/output", data)
+// putToBlobStore uploads a file to a presigned URL
+func putToBlobStore(client *http.Client, location *url.URL, u *upload, contentType string) error {
+	req, err := http.NewRequest("PUT", location.String(), u.body())
 	if err != nil {
 		return err
 	}
-	return checkOK(resp)
+	// The blob store needs to know the size up front
+	req.ContentLength = u.size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The blob store doesn't answer with JSON like the server does
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("blob store: " + resp.Status)
+	}
+	return nil
+}
+
+// PutApp uploads the tarred & gzipped scraper code
+func (run *Run) PutApp(appData io.Reader) error {
+	return run.put("/app", appData, "application/gzip")
+}
+
+// PutCache uploads the tarred & gzipped build cache
+func (run *Run) PutCache(data io.Reader) error {
+	return run.put("/cache", data, "application/gzip")
+}
+
+// PutOutput uploads the output of the scraper
+func (run *Run) PutOutput(data io.Reader) error {
+	return run.put("/output", data, "application/octet-stream")
 }
 
 // GetCache downloads the tarred & gzipped build cache
@@ -274,9 +456,10 @@ func (iterator *EventIterator) Next() (event protocol.Event, err error) {
 
 // GetEvents returns a stream of events from the API
 // If lastID is empty ("") then the stream starts from the beginning. Otherwise
-// it starts from the first event after the one with the given ID.
-func (run *Run) GetEvents(lastID string) (*EventIterator, error) {
-	q := url.Values{}
+// it starts from the first event after the one with the given ID. Only events that
+// match filter are sent (apart from the last event which always is).
+func (run *Run) GetEvents(lastID string, filter protocol.EventFilter) (*EventIterator, error) {
+	q := filterValues(filter)
 	q.Add("last_id", lastID)
 	resp, err := run.request("GET", "/events?"+q.Encode(), nil)
 	if err != nil {
@@ -291,6 +474,85 @@ func (run *Run) GetEvents(lastID string) (*EventIterator, error) {
 	return &EventIterator{decoder: json.NewDecoder(resp.Body)}, nil
 }
 
+// GetEventsPage returns the events that exist now after lastID (up to limit of them) without
+// waiting for any more. Use the cursor of the returned page as lastID to get the next page.
+// A limit of 0 means no limit.
+func (run *Run) GetEventsPage(lastID string, filter protocol.EventFilter, limit int) (protocol.EventsPage, error) {
+	var page protocol.EventsPage
+	q := filterValues(filter)
+	q.Add("last_id", lastID)
+	q.Add("follow", "false")
+	if limit != 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	resp, err := run.request("GET", "/events?"+q.Encode(), nil)
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+	if err = checkOK(resp); err != nil {
+		return page, err
+	}
+	if err = checkContentType(resp, "application/json"); err != nil {
+		return page, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
+func filterValues(filter protocol.EventFilter) url.Values {
+	q := url.Values{}
+	for _, t := range filter.Types {
+		q.Add("type", t)
+	}
+	for _, s := range filter.Stages {
+		q.Add("stage", s)
+	}
+	for _, s := range filter.Streams {
+		q.Add("stream", s)
+	}
+	return q
+}
+
+// LogsOptions control what logs GetLogs returns and how they look
+type LogsOptions struct {
+	// Only include logs from these stages and streams. Empty means all of them.
+	Stages  []string
+	Streams []string
+	// Start each line with when it was logged
+	Timestamps bool
+	// Start each line with the stage and stream it came from
+	Prefixes bool
+}
+
+// GetLogs returns the logs of the run so far as plain text. It doesn't wait for any more.
+func (run *Run) GetLogs(options LogsOptions) (io.ReadCloser, error) {
+	q := url.Values{}
+	for _, s := range options.Stages {
+		q.Add("stage", s)
+	}
+	for _, s := range options.Streams {
+		q.Add("stream", s)
+	}
+	if options.Timestamps {
+		q.Add("timestamps", "true")
+	}
+	if options.Prefixes {
+		q.Add("prefixes", "true")
+	}
+	resp, err := run.request("GET", "/logs?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOK(resp); err != nil {
+		return nil, err
+	}
+	if err = checkContentType(resp, "text/plain; charset=utf-8"); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
 // CreateEvent sends an event and returns an approximation of the number of bytes sent
 func (run *Run) CreateEvent(event protocol.Event) (int, error) {
 	b, err := json.Marshal(event)
@@ -318,6 +580,29 @@ func (run *Run) GetExitData() (exitData protocol.ExitData, err error) {
 	return
 }
 
+// GetStatus gets the current state of the run
+func (run *Run) GetStatus() (status protocol.RunStatus, err error) {
+	resp, err := run.request("GET", "/status", nil)
+	if err != nil {
+		return
+	}
+	if err = checkOK(resp); err != nil {
+		return
+	}
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&status)
+	return
+}
+
+// Cancel stops the run while keeping its events, exit data and output around
+func (run *Run) Cancel() error {
+	resp, err := run.request("POST", "/cancel", nil)
+	if err != nil {
+		return err
+	}
+	return checkOK(resp)
+}
+
 // Delete cleans up after a run is complete
 func (run *Run) Delete() error {
 	resp, err := run.request("DELETE", "", nil)
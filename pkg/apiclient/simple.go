@@ -106,7 +106,7 @@ func SimpleConnect(runID string, scraperDirectory string, clientServerURL string
 	run := &Run{Client: New(clientServerURL), Run: protocol.Run{ID: runID}}
 
 	// Listen for events
-	events, err := run.GetEvents("")
+	events, err := run.GetEvents("", protocol.EventFilter{})
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package apiserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,20 +9,37 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/gorilla/mux"
 	"github.com/openaustralia/yinyo/pkg/commands"
 	"github.com/openaustralia/yinyo/pkg/integrationclient"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
 	"github.com/openaustralia/yinyo/pkg/protocol"
 )
 
 func (server *Server) createRun(w http.ResponseWriter, r *http.Request) error {
-	createResult, err := server.app.CreateRun(protocol.CreateRunOptions{APIKey: r.URL.Query().Get("api_key")})
+	// The body is optional
+	var options protocol.CreateRunOptions
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&options)
+		if err != nil {
+			return newHTTPError(err, http.StatusBadRequest, "JSON in body not correctly formatted")
+		}
+	}
+	options.APIKey = r.URL.Query().Get("api_key")
+
+	createResult, err := server.app.CreateRun(options)
 	if err != nil {
 		if errors.Is(err, integrationclient.ErrNotAllowed) {
 			return newHTTPError(err, http.StatusUnauthorized, err.Error())
+		} else if errors.Is(err, jobdispatcher.ErrInvalidLabels) {
+			return newHTTPError(err, http.StatusBadRequest, err.Error())
 		}
 		return err
 	}
@@ -30,68 +48,125 @@ func (server *Server) createRun(w http.ResponseWriter, r *http.Request) error {
 	return json.NewEncoder(w).Encode(createResult)
 }
 
-func (server *Server) getApp(w http.ResponseWriter, r *http.Request) error {
-	runID := mux.Vars(r)["id"]
-	w.Header().Set("Content-Type", "application/gzip")
-	reader, err := server.app.GetApp(runID)
+// The number of runs in a page if the client doesn't say
+const defaultListRunsLimit = 100
+
+func (server *Server) listRuns(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	limit, err := nonNegativeInt(q.Get("limit"))
+	if err != nil {
+		return newHTTPError(err, http.StatusBadRequest, "limit should be a positive integer")
+	}
+	if limit == 0 {
+		limit = defaultListRunsLimit
+	}
+	after, err := nonNegativeInt(q.Get("cursor"))
+	if err != nil {
+		return newHTTPError(err, http.StatusBadRequest, "cursor isn't valid")
+	}
+	page, err := server.app.ListRuns(commands.ListRunsOptions{
+		APIKey: q.Get("api_key"),
+		Phases: splitValues(q["phase"]),
+		After:  int64(after),
+		Limit:  limit,
+	})
 	if err != nil {
-		// Returns 404 if there is no app
+		if errors.Is(err, integrationclient.ErrNotAllowed) {
+			return newHTTPError(err, http.StatusUnauthorized, err.Error())
+		}
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(page)
+}
+
+// nonNegativeInt parses an optional integer query parameter. If it's empty it's 0.
+func nonNegativeInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err == nil && i < 0 {
+		err = fmt.Errorf("%v is negative", i)
+	}
+	return i, err
+}
+
+// getBlob sends a file to the client or, if presigned URLs are being used, redirects the
+// client to get it directly from the blob store. It's a temporary redirect so that the client
+// keeps asking us in future.
+func getBlob(w http.ResponseWriter, r *http.Request, runID string, getURL func(string) (*url.URL, error), get func(string) (io.ReadCloser, error), contentType string) error {
+	u, err := getURL(runID)
+	var reader io.ReadCloser
+	if err == nil && u == nil {
+		reader, err = get(runID)
+	}
+	if err != nil {
+		// Returns 404 if the file doesn't exist
 		if errors.Is(err, commands.ErrNotFound) {
 			return newHTTPError(err, http.StatusNotFound, err.Error())
 		}
 		return err
 	}
+	if u != nil {
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+		return nil
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", contentType)
 	_, err = io.Copy(w, reader)
 	return err
 }
 
+// putBlob saves a file from the client or, if presigned URLs are being used, redirects the
+// client to put it directly in the blob store. The redirect is sent without reading the body
+// so a client that sends "Expect: 100-continue" only has to send the file once.
+func putBlob(w http.ResponseWriter, r *http.Request, runID string, putURL func(string) (*url.URL, error), put func(string, io.Reader, int64) error) error {
+	u, err := putURL(runID)
+	if err != nil {
+		return err
+	}
+	if u != nil {
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+		return nil
+	}
+	return put(runID, r.Body, r.ContentLength)
+}
+
+func (server *Server) getApp(w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["id"]
+	return getBlob(w, r, runID, server.app.GetAppURL, server.app.GetApp, "application/gzip")
+}
+
 func (server *Server) putApp(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
-	err := server.app.PutApp(runID, r.Body, r.ContentLength)
+	err := putBlob(w, r, runID, server.app.PutAppURL, server.app.PutApp)
 	if errors.Is(err, commands.ErrArchiveFormat) {
 		return newHTTPError(err, http.StatusBadRequest, err.Error())
+	} else if errors.Is(err, commands.ErrInvalidState) {
+		return newHTTPError(err, http.StatusConflict, "app can't be changed after the run has started")
 	}
 	return err
 }
 
 func (server *Server) getCache(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
-	reader, err := server.app.GetCache(runID)
-	if err != nil {
-		// Returns 404 if there is no cache
-		if errors.Is(err, commands.ErrNotFound) {
-			return newHTTPError(err, http.StatusNotFound, err.Error())
-		}
-		return err
-	}
-	w.Header().Set("Content-Type", "application/gzip")
-	_, err = io.Copy(w, reader)
-	return err
+	return getBlob(w, r, runID, server.app.GetCacheURL, server.app.GetCache, "application/gzip")
 }
 
 func (server *Server) putCache(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
-	return server.app.PutCache(runID, r.Body, r.ContentLength)
+	return putBlob(w, r, runID, server.app.PutCacheURL, server.app.PutCache)
 }
 
 func (server *Server) getOutput(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
-	reader, err := server.app.GetOutput(runID)
-	if err != nil {
-		// Returns 404 if there is no output
-		if errors.Is(err, commands.ErrNotFound) {
-			return newHTTPError(err, http.StatusNotFound, err.Error())
-		}
-		return err
-	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	_, err = io.Copy(w, reader)
-	return err
+	return getBlob(w, r, runID, server.app.GetOutputURL, server.app.GetOutput, "application/octet-stream")
 }
 
 func (server *Server) putOutput(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
-	return server.app.PutOutput(runID, r.Body, r.ContentLength)
+	return putBlob(w, r, runID, server.app.PutOutputURL, server.app.PutOutput)
 }
 
 func (server *Server) getExitData(w http.ResponseWriter, r *http.Request) error {
@@ -107,6 +182,19 @@ func (server *Server) getExitData(w http.ResponseWriter, r *http.Request) error
 	return enc.Encode(exitData)
 }
 
+func (server *Server) getStatus(w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["id"]
+
+	status, err := server.app.GetStatus(runID)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	return enc.Encode(status)
+}
+
 func (server *Server) startRun(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
 
@@ -129,6 +217,12 @@ func (server *Server) startRun(w http.ResponseWriter, r *http.Request) error {
 		return newHTTPError(err, http.StatusBadRequest, fmt.Sprintf("memory should not be larger than %v", server.maxMemory))
 	}
 
+	if options.CPU == 0 {
+		options.CPU = server.defaultCPU
+	} else if options.CPU > server.maxCPU {
+		return newHTTPError(err, http.StatusBadRequest, fmt.Sprintf("cpu should not be larger than %v", server.maxCPU))
+	}
+
 	env := make(map[string]string)
 	for _, keyvalue := range options.Env {
 		env[keyvalue.Name] = keyvalue.Value
@@ -137,8 +231,14 @@ func (server *Server) startRun(w http.ResponseWriter, r *http.Request) error {
 	err = server.app.StartRun(runID, server.runDockerImage, options)
 	if errors.Is(err, commands.ErrAppNotAvailable) {
 		err = newHTTPError(err, http.StatusBadRequest, "app needs to be uploaded before starting a run")
+	} else if errors.Is(err, commands.ErrArchiveFormat) {
+		err = newHTTPError(err, http.StatusBadRequest, err.Error())
 	} else if errors.Is(err, integrationclient.ErrNotAllowed) {
 		err = newHTTPError(err, http.StatusUnauthorized, err.Error())
+	} else if errors.Is(err, jobdispatcher.ErrSchedulingNotAllowed) {
+		err = newHTTPError(err, http.StatusBadRequest, err.Error())
+	} else if errors.Is(err, commands.ErrInvalidState) {
+		err = newHTTPError(err, http.StatusConflict, "run can't be started in its current state")
 	}
 	return err
 }
@@ -146,24 +246,57 @@ func (server *Server) startRun(w http.ResponseWriter, r *http.Request) error {
 func (server *Server) getEvents(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
 	lastID := r.URL.Query().Get("last_id")
+	// Browsers using EventSource send the id of the last event they saw when they reconnect
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse && r.Header.Get("Last-Event-ID") != "" {
+		lastID = r.Header.Get("Last-Event-ID")
+	}
 	if lastID == "" {
 		lastID = "0"
 	}
-	w.Header().Set("Content-Type", "application/ld+json")
+	limit, err := nonNegativeInt(r.URL.Query().Get("limit"))
+	if err != nil {
+		return newHTTPError(err, http.StatusBadRequest, "limit should be a positive integer")
+	}
+	options := commands.EventsOptions{
+		LastID: lastID,
+		Filter: eventFilter(r.URL.Query()),
+		Follow: r.URL.Query().Get("follow") != "false",
+		Limit:  limit,
+	}
+	if !options.Follow {
+		return server.getEventsPage(w, r, runID, options)
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/ld+json")
+	}
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		return errors.New("couldn't access the flusher")
 	}
 
-	events := server.app.GetEvents(runID, lastID)
+	events := server.app.GetEvents(runID, options)
+	defer events.Close()
 	enc := json.NewEncoder(w)
 	for events.More() {
-		e, err := events.Next()
+		// Stop waiting for events as soon as the client goes away
+		e, err := events.Next(r.Context())
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		err = enc.Encode(e)
+		if sse {
+			err = writeServerSentEvent(w, e)
+		} else {
+			err = enc.Encode(e)
+		}
 		if err != nil {
 			return err
 		}
@@ -172,6 +305,104 @@ func (server *Server) getEvents(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// getEventsPage returns the events that exist now (up to the limit) in one go rather than
+// following them
+func (server *Server) getEventsPage(w http.ResponseWriter, r *http.Request, runID string, options commands.EventsOptions) error {
+	page := protocol.EventsPage{Events: []protocol.Event{}, Cursor: options.LastID}
+	events := server.app.GetEvents(runID, options)
+	defer events.Close()
+	for events.More() {
+		e, err := events.Next(r.Context())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		page.Events = append(page.Events, e)
+		page.Cursor = e.ID
+	}
+	// We only stopped early if we got to the limit before the last event
+	if options.Limit != 0 && len(page.Events) == options.Limit {
+		_, last := page.Events[len(page.Events)-1].Data.(protocol.LastData)
+		page.More = !last
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(page)
+}
+
+// getLogs returns the logs that exist so far as plain text without waiting for any more
+func (server *Server) getLogs(w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	filter := eventFilter(q)
+	filter.Types = []string{"log"}
+	timestamps := q.Get("timestamps") == "true"
+	prefixes := q.Get("prefixes") == "true"
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	events := server.app.GetEvents(runID, commands.EventsOptions{LastID: "0", Filter: filter})
+	defer events.Close()
+	for events.More() {
+		e, err := events.Next(r.Context())
+		if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		l, ok := e.Data.(protocol.LogData)
+		if !ok {
+			continue
+		}
+		var line string
+		if timestamps {
+			line += e.Time.Format(time.RFC3339) + " "
+		}
+		if prefixes {
+			line += fmt.Sprintf("[%v/%v] ", l.Stage, l.Stream)
+		}
+		_, err = fmt.Fprintln(w, line+l.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventFilter reads the filter from the query parameters. Each can either be given more
+// than once or as a comma separated list.
+func eventFilter(q url.Values) protocol.EventFilter {
+	return protocol.EventFilter{
+		Types:   splitValues(q["type"]),
+		Stages:  splitValues(q["stage"]),
+		Streams: splitValues(q["stream"]),
+	}
+}
+
+func splitValues(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// writeServerSentEvent writes the event in the text/event-stream format. The id is the id of
+// the event in the stream so that EventSource can resume from where it left off.
+func writeServerSentEvent(w io.Writer, e protocol.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %v\ndata: %s\n\n", e.ID, b)
+	return err
+}
+
 func (server *Server) createEvent(w http.ResponseWriter, r *http.Request) error {
 	runID := mux.Vars(r)["id"]
 
@@ -189,7 +420,11 @@ func (server *Server) createEvent(w http.ResponseWriter, r *http.Request) error
 		return newHTTPError(err, http.StatusBadRequest, "JSON in body not correctly formatted")
 	}
 
-	return server.app.CreateEvent(runID, event)
+	err = server.app.CreateEvent(runID, event)
+	if errors.Is(err, commands.ErrInvalidState) {
+		return newHTTPError(err, http.StatusConflict, "run has already finished")
+	}
+	return err
 }
 
 func (server *Server) delete(w http.ResponseWriter, r *http.Request) error {
@@ -198,6 +433,12 @@ func (server *Server) delete(w http.ResponseWriter, r *http.Request) error {
 	return server.app.DeleteRun(runID)
 }
 
+func (server *Server) cancel(w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["id"]
+
+	return server.app.CancelRun(runID)
+}
+
 func (server *Server) hello(w http.ResponseWriter, r *http.Request) error {
 	hello := protocol.Hello{
 		Message: "Hello from Yinyo!",
@@ -209,6 +450,10 @@ func (server *Server) hello(w http.ResponseWriter, r *http.Request) error {
 			Default: server.defaultMemory,
 			Max:     server.maxMemory,
 		},
+		CPU: protocol.DefaultAndMax{
+			Default: server.defaultCPU,
+			Max:     server.maxCPU,
+		},
 		Version:     server.version,
 		RunnerImage: server.runDockerImage,
 	}
@@ -345,13 +590,15 @@ type Server struct {
 	maxRunTime        int64 // the global maximum run time in seconds that every run can not exceed
 	defaultMemory     int64 // If the user doesn't specify memory for a run this is what is used
 	maxMemory         int64 // The user can't get memory for a run above this value. Probably limit this to what is schedulable on a single kubernetes worker node
+	defaultCPU        int64 // If the user doesn't specify cpu (in millicores) for a run this is what is used
+	maxCPU            int64 // The user can't get cpu (in millicores) for a run above this value
 	runDockerImage    string
 	version           string
 }
 
 // Initialise the server's state
 func (server *Server) Initialise(startupOptions *commands.StartupOptions,
-	defaultMaxRunTime, maxRunTime, defaultMemory, maxMemory int64,
+	defaultMaxRunTime, maxRunTime, defaultMemory, maxMemory, defaultCPU, maxCPU int64,
 	runDockerImage string, version string) error {
 	app, err := commands.New(startupOptions)
 	if err != nil {
@@ -362,6 +609,8 @@ func (server *Server) Initialise(startupOptions *commands.StartupOptions,
 	server.maxRunTime = maxRunTime
 	server.defaultMemory = defaultMemory
 	server.maxMemory = maxMemory
+	server.defaultCPU = defaultCPU
+	server.maxCPU = maxCPU
 	server.runDockerImage = runDockerImage
 	server.version = version
 	server.InitialiseRoutes()
@@ -373,6 +622,7 @@ func (server *Server) InitialiseRoutes() {
 	server.router = mux.NewRouter().StrictSlash(true)
 	server.router.Handle("/", appHandler(server.hello))
 	server.router.Handle("/runs", appHandler(server.createRun)).Methods("POST")
+	server.router.Handle("/runs", appHandler(server.listRuns)).Methods("GET")
 
 	runRouter := server.router.PathPrefix("/runs/{id}").Subrouter()
 	runRouter.Handle("/app", appHandler(server.getApp)).Methods("GET")
@@ -382,9 +632,13 @@ func (server *Server) InitialiseRoutes() {
 	runRouter.Handle("/output", appHandler(server.getOutput)).Methods("GET")
 	runRouter.Handle("/output", appHandler(server.putOutput)).Methods("PUT")
 	runRouter.Handle("/exit-data", appHandler(server.getExitData)).Methods("GET")
+	runRouter.Handle("/status", appHandler(server.getStatus)).Methods("GET")
 	runRouter.Handle("/start", appHandler(server.startRun)).Methods("POST")
+	runRouter.Handle("/cancel", appHandler(server.cancel)).Methods("POST")
 	runRouter.Handle("/events", appHandler(server.getEvents)).Methods("GET")
 	runRouter.Handle("/events", appHandler(server.createEvent)).Methods("POST")
+	runRouter.Handle("/logs", appHandler(server.getLogs)).Methods("GET")
+	runRouter.Handle("/websocket", appHandler(server.runWebSocket)).Methods("GET")
 	runRouter.Handle("", appHandler(server.delete)).Methods("DELETE")
 	server.router.Use(server.recordTraffic)
 	runRouter.Use(server.checkRunCreated)
@@ -1,16 +1,26 @@
 package apiserver
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	commandsmocks "github.com/openaustralia/yinyo/mocks/pkg/commands"
 	"github.com/openaustralia/yinyo/pkg/commands"
+	"github.com/openaustralia/yinyo/pkg/integrationclient"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
 	"github.com/openaustralia/yinyo/pkg/protocol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -18,10 +28,15 @@ import (
 
 // Makes a request to the server and records the response for testing purposes
 func makeRequest(app commands.App, method, url string, body io.Reader) *httptest.ResponseRecorder {
-	server := Server{app: app, defaultMaxRunTime: 3600, maxRunTime: 86400, defaultMemory: 1073741824, maxMemory: 1610612736, version: "development", runDockerImage: "openaustralia/yinyo-runner:abc"}
+	return makeRequestWithHeader(app, method, url, body, http.Header{})
+}
+
+func makeRequestWithHeader(app commands.App, method, url string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	server := Server{app: app, defaultMaxRunTime: 3600, maxRunTime: 86400, defaultMemory: 1073741824, maxMemory: 1610612736, defaultCPU: 1000, maxCPU: 2000, version: "development", runDockerImage: "openaustralia/yinyo-runner:abc"}
 	server.InitialiseRoutes()
 
 	req, _ := http.NewRequest(method, url, body)
+	req.Header = header
 	// Make the request come "internally"
 	req.RemoteAddr = "10.0.0.1:11111"
 
@@ -44,6 +59,89 @@ func TestCreateRun(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestCreateRunWithLabels(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("CreateRun", protocol.CreateRunOptions{APIKey: "abc", Labels: map[string]string{"scraper": "planningalerts"}}).Return(protocol.Run{ID: "run-foo"}, nil)
+
+	rr := makeRequest(app, "POST", "/runs?api_key=abc", strings.NewReader(`{"labels":{"scraper":"planningalerts"}}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"id":"run-foo"}
+`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestCreateRunInvalidLabels(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("CreateRun", protocol.CreateRunOptions{Labels: map[string]string{"scraper": "not valid"}}).Return(
+		protocol.Run{}, fmt.Errorf("%w: value \"not valid\"", jobdispatcher.ErrInvalidLabels),
+	)
+
+	rr := makeRequest(app, "POST", "/runs", strings.NewReader(`{"labels":{"scraper":"not valid"}}`))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"invalid labels: value \"not valid\""}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestCreateRunBadBody(t *testing.T) {
+	app := new(commandsmocks.App)
+
+	rr := makeRequest(app, "POST", "/runs", strings.NewReader(`{"labels":"foo"}`))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"JSON in body not correctly formatted"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestListRuns(t *testing.T) {
+	app := new(commandsmocks.App)
+	createdAt := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	app.On("ListRuns", commands.ListRunsOptions{APIKey: "abc", Phases: []string{"created", "started"}, After: 10, Limit: 1}).Return(protocol.RunsPage{
+		Runs:   []protocol.RunSummary{{ID: "run-foo", CreatedAt: createdAt, Phase: "started"}},
+		Cursor: "11",
+		More:   true,
+	}, nil)
+
+	rr := makeRequest(app, "GET", "/runs?api_key=abc&phase=created,started&cursor=10&limit=1", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"runs":[{"id":"run-foo","created_at":"2000-01-02T03:45:00Z","phase":"started","exit_data":{"finished":false}}],"cursor":"11","more":true}
+`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, rr.Header())
+	app.AssertExpectations(t)
+}
+
+func TestListRunsDefaultLimit(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("ListRuns", commands.ListRunsOptions{Limit: 100}).Return(protocol.RunsPage{Runs: []protocol.RunSummary{}, Cursor: "0"}, nil)
+
+	rr := makeRequest(app, "GET", "/runs", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	app.AssertExpectations(t)
+}
+
+func TestListRunsNotAllowed(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("ListRuns", commands.ListRunsOptions{APIKey: "abc", Limit: 100}).Return(protocol.RunsPage{}, fmt.Errorf("%w: Unknown key", integrationclient.ErrNotAllowed))
+
+	rr := makeRequest(app, "GET", "/runs?api_key=abc", nil)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `{"error":"Not allowed: Unknown key"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestListRunsBadCursor(t *testing.T) {
+	app := new(commandsmocks.App)
+
+	rr := makeRequest(app, "GET", "/runs?cursor=foo", nil)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"cursor isn't valid"}`, rr.Body.String())
+}
+
 func TestCreateRunInternalServerError(t *testing.T) {
 	app := new(commandsmocks.App)
 	// There was some kind of internal error when creating a run
@@ -74,7 +172,7 @@ func TestStartBadBody(t *testing.T) {
 func TestStartNoApp(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "foo").Return(true, nil)
-	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824}).Return(commands.ErrAppNotAvailable)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824, CPU: 1000}).Return(commands.ErrAppNotAvailable)
 
 	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{}`))
 
@@ -84,10 +182,39 @@ func TestStartNoApp(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+// An app that was uploaded directly to the blob store is only checked when the run is started
+func TestStartBadApp(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "foo").Return(true, nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824, CPU: 1000}).Return(
+		fmt.Errorf("%w: unexpected EOF", commands.ErrArchiveFormat),
+	)
+
+	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{}`))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"archive format: unexpected EOF"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+// Starting a run twice is an error
+func TestStartAlreadyStarted(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "foo").Return(true, nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824, CPU: 1000}).Return(fmt.Errorf("run is started: %w", commands.ErrInvalidState))
+
+	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{}`))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, `{"error":"run can't be started in its current state"}`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}, rr.Header())
+	app.AssertExpectations(t)
+}
+
 func TestStartWithDefaults(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "foo").Return(true, nil)
-	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824}).Return(nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824, CPU: 1000}).Return(nil)
 
 	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader("{}"))
 
@@ -99,7 +226,7 @@ func TestStartWithDefaults(t *testing.T) {
 func TestStartLowerMaxRunTime(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "foo").Return(true, nil)
-	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 120, Memory: 1073741824}).Return(nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 120, Memory: 1073741824, CPU: 1000}).Return(nil)
 
 	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{"max_run_time": 120}`))
 
@@ -124,7 +251,7 @@ func TestStartHigherMaxRunTime(t *testing.T) {
 func TestStartLowerMaxMemory(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "foo").Return(true, nil)
-	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1024}).Return(nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1024, CPU: 1000}).Return(nil)
 
 	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{"memory": 1024}`))
 
@@ -146,6 +273,49 @@ func TestStartHigherMaxMemory(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestStartLowerMaxCPU(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "foo").Return(true, nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{MaxRunTime: 3600, Memory: 1073741824, CPU: 1500}).Return(nil)
+
+	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{"cpu": 1500}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	app.AssertExpectations(t)
+}
+
+func TestStartHigherMaxCPU(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "foo").Return(true, nil)
+
+	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{"cpu": 4000}`))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"cpu should not be larger than 2000"}`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}, rr.Header())
+
+	app.AssertExpectations(t)
+}
+
+func TestStartSchedulingNotAllowed(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "foo").Return(true, nil)
+	app.On("StartRun", "foo", "openaustralia/yinyo-runner:abc", protocol.StartRunOptions{
+		MaxRunTime: 3600,
+		Memory:     1073741824,
+		CPU:        1000,
+		Scheduling: protocol.Scheduling{PriorityClass: "urgent"},
+	}).Return(fmt.Errorf("%w: priority class \"urgent\" can not be used", jobdispatcher.ErrSchedulingNotAllowed))
+
+	rr := makeRequest(app, "POST", "/runs/foo/start", strings.NewReader(`{"scheduling": {"priority_class": "urgent"}}`))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"scheduling not allowed: priority class \"urgent\" can not be used"}`, rr.Body.String())
+
+	app.AssertExpectations(t)
+}
+
 func TestCreateEventBadBody(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "foo").Return(true, nil)
@@ -161,6 +331,7 @@ func TestCreateEventBadBody(t *testing.T) {
 func TestPutApp(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "run-name").Return(true, nil)
+	app.On("PutAppURL", "run-name").Return(nil, nil)
 	app.On("PutApp", "run-name", mock.Anything, int64(3)).Return(nil)
 
 	rr := makeRequest(app, "PUT", "/runs/run-name/app", strings.NewReader("foo"))
@@ -169,6 +340,31 @@ func TestPutApp(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestPutAppAfterStart(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "run-name").Return(true, nil)
+	app.On("PutAppURL", "run-name").Return(nil, nil)
+	app.On("PutApp", "run-name", mock.Anything, int64(3)).Return(fmt.Errorf("run is started: %w", commands.ErrInvalidState))
+
+	rr := makeRequest(app, "PUT", "/runs/run-name/app", strings.NewReader("foo"))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, `{"error":"app can't be changed after the run has started"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestCreateEventAfterLast(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "foo").Return(true, nil)
+	app.On("CreateEvent", "foo", mock.Anything).Return(fmt.Errorf("run is finished: %w", commands.ErrInvalidState))
+
+	rr := makeRequest(app, "POST", "/runs/foo/events", strings.NewReader(`{"time":"2000-01-02T03:45:00Z","type":"last","data":{}}`))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, `{"error":"run has already finished"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
 func TestPutAppWrongRunName(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "does-not-exist").Return(false, nil)
@@ -181,16 +377,30 @@ func TestPutAppWrongRunName(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+// closeRecorder remembers whether it was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
 func TestGetApp(t *testing.T) {
 	app := new(commandsmocks.App)
+	reader := &closeRecorder{Reader: strings.NewReader("code stuff")}
 	app.On("IsRunCreated", "my-run").Return(true, nil)
-	app.On("GetApp", "my-run").Return(strings.NewReader("code stuff"), nil)
+	app.On("GetAppURL", "my-run").Return(nil, nil)
+	app.On("GetApp", "my-run").Return(reader, nil)
 
 	rr := makeRequest(app, "GET", "/runs/my-run/app", nil)
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Equal(t, "code stuff", rr.Body.String())
 	assert.Equal(t, http.Header{"Content-Type": []string{"application/gzip"}}, rr.Header())
+	assert.True(t, reader.closed)
 	app.AssertExpectations(t)
 }
 
@@ -198,6 +408,7 @@ func TestGetApp(t *testing.T) {
 func TestGetAppErrNotFound(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetAppURL", "my-run").Return(nil, nil)
 	app.On("GetApp", "my-run").Return(nil, commands.ErrNotFound)
 
 	rr := makeRequest(app, "GET", "/runs/my-run/app", nil)
@@ -211,7 +422,8 @@ func TestGetAppErrNotFound(t *testing.T) {
 func TestGetCache(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "my-run").Return(true, nil)
-	app.On("GetCache", "my-run").Return(strings.NewReader("cached stuff"), nil)
+	app.On("GetCacheURL", "my-run").Return(nil, nil)
+	app.On("GetCache", "my-run").Return(ioutil.NopCloser(strings.NewReader("cached stuff")), nil)
 
 	rr := makeRequest(app, "GET", "/runs/my-run/cache", nil)
 
@@ -224,6 +436,7 @@ func TestGetCache(t *testing.T) {
 func TestPutCache(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("PutCacheURL", "my-run").Return(nil, nil)
 	app.On("PutCache", "my-run", mock.Anything, int64(12)).Return(nil)
 
 	rr := makeRequest(app, "PUT", "/runs/my-run/cache", strings.NewReader("cached stuff"))
@@ -235,7 +448,8 @@ func TestPutCache(t *testing.T) {
 func TestGetOutput(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "my-run").Return(true, nil)
-	app.On("GetOutput", "my-run").Return(strings.NewReader("output stuff"), nil)
+	app.On("GetOutputURL", "my-run").Return(nil, nil)
+	app.On("GetOutput", "my-run").Return(ioutil.NopCloser(strings.NewReader("output stuff")), nil)
 
 	rr := makeRequest(app, "GET", "/runs/my-run/output", nil)
 
@@ -248,6 +462,7 @@ func TestGetOutput(t *testing.T) {
 func TestPutOutput(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("PutOutputURL", "my-run").Return(nil, nil)
 	app.On("PutOutput", "my-run", mock.Anything, int64(12)).Return(nil)
 
 	rr := makeRequest(app, "PUT", "/runs/my-run/output", strings.NewReader("output stuff"))
@@ -256,6 +471,57 @@ func TestPutOutput(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestGetCacheRedirect(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	u, _ := url.Parse("https://blobs.example.com/yinyo/my-run/cache.tgz?X-Amz-Signature=abc")
+	app.On("GetCacheURL", "my-run").Return(u, nil)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/cache", nil)
+
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+	assert.Equal(t, "https://blobs.example.com/yinyo/my-run/cache.tgz?X-Amz-Signature=abc", rr.Header().Get("Location"))
+	app.AssertExpectations(t)
+}
+
+func TestGetCacheRedirectNotFound(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetCacheURL", "my-run").Return(nil, commands.ErrNotFound)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/cache", nil)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, `{"error":"not found"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestPutCacheRedirect(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	u, _ := url.Parse("https://blobs.example.com/yinyo/my-run/cache.tgz?X-Amz-Signature=abc")
+	app.On("PutCacheURL", "my-run").Return(u, nil)
+
+	// The cache itself doesn't get saved by the server
+	rr := makeRequest(app, "PUT", "/runs/my-run/cache", strings.NewReader("cached stuff"))
+
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+	assert.Equal(t, "https://blobs.example.com/yinyo/my-run/cache.tgz?X-Amz-Signature=abc", rr.Header().Get("Location"))
+	app.AssertExpectations(t)
+}
+
+func TestPutAppRedirectAfterStart(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "run-name").Return(true, nil)
+	app.On("PutAppURL", "run-name").Return(nil, fmt.Errorf("run is started: %w", commands.ErrInvalidState))
+
+	rr := makeRequest(app, "PUT", "/runs/run-name/app", strings.NewReader("foo"))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, `{"error":"app can't be changed after the run has started"}`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
 func TestGetExitData(t *testing.T) {
 	app := new(commandsmocks.App)
 	exitData := protocol.ExitData{
@@ -276,6 +542,20 @@ func TestGetExitData(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestGetStatus(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetStatus", "my-run").Return(protocol.RunStatus{State: "failed", Restarts: 5}, nil)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/status", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"state":"failed","restarts":5}
+`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, rr.Header())
+	app.AssertExpectations(t)
+}
+
 // Make a fake event iterator that we can use for testing
 type events struct {
 	contents []protocol.Event
@@ -286,12 +566,16 @@ func (e *events) More() bool {
 	return e.index < len(e.contents)
 }
 
-func (e *events) Next() (protocol.Event, error) {
+func (e *events) Next(ctx context.Context) (protocol.Event, error) {
 	event := e.contents[e.index]
 	e.index++
 	return event, nil
 }
 
+func (e *events) Close() error {
+	return nil
+}
+
 func TestGetEvents(t *testing.T) {
 	app := new(commandsmocks.App)
 	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
@@ -300,7 +584,7 @@ func TestGetEvents(t *testing.T) {
 		protocol.NewFinishEvent("", "abc", time, "build", protocol.ExitDataStage{}),
 	}}
 	app.On("IsRunCreated", "my-run").Return(true, nil)
-	app.On("GetEvents", "my-run", "0").Return(events)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Follow: true}).Return(events)
 
 	rr := makeRequest(app, "GET", "/runs/my-run/events", nil)
 
@@ -313,6 +597,167 @@ func TestGetEvents(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestGetEventsFiltered(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{
+		LastID: "0",
+		Filter: protocol.EventFilter{
+			Types:   []string{"log", "last"},
+			Stages:  []string{"execute"},
+			Streams: []string{"stderr"},
+		},
+		Follow: true,
+	}).Return(&events{})
+
+	rr := makeRequest(app, "GET", "/runs/my-run/events?type=log,last&stage=execute&stream=stderr", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	app.AssertExpectations(t)
+}
+
+func TestGetEventsClientGone(t *testing.T) {
+	app := new(commandsmocks.App)
+	iterator := new(commandsmocks.EventIterator)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Follow: true}).Return(iterator)
+	iterator.On("More").Return(true)
+	iterator.On("Close").Return(nil)
+	iterator.On("Next", mock.Anything).Return(protocol.Event{}, context.Canceled)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/events", nil)
+
+	// Nothing more is written because there's no one to write it to
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "", rr.Body.String())
+	app.AssertExpectations(t)
+	iterator.AssertExpectations(t)
+}
+
+func TestGetEventsPage(t *testing.T) {
+	app := new(commandsmocks.App)
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	events := &events{contents: []protocol.Event{
+		protocol.NewStartEvent("123-0", "abc", time, "build"),
+		protocol.NewFinishEvent("123-1", "abc", time, "build", protocol.ExitDataStage{}),
+	}}
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Limit: 2}).Return(events)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/events?follow=false&limit=2", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"events":[{"id":"123-0","run_id":"abc","time":"2000-01-02T03:45:00Z","type":"start","data":{"stage":"build"}},{"id":"123-1","run_id":"abc","time":"2000-01-02T03:45:00Z","type":"finish","data":{"stage":"build","exit_data":{"exit_code":0,"usage":{"max_rss":0,"network_in":0,"network_out":0}}}}],"cursor":"123-1","more":true}
+`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, rr.Header())
+	app.AssertExpectations(t)
+}
+
+func TestGetEventsPageEmpty(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "123-1"}).Return(&events{})
+
+	rr := makeRequest(app, "GET", "/runs/my-run/events?follow=false&last_id=123-1", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"events":[],"cursor":"123-1","more":false}
+`, rr.Body.String())
+	app.AssertExpectations(t)
+}
+
+func TestGetEventsBadLimit(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/events?follow=false&limit=foo", nil)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	app.AssertExpectations(t)
+}
+
+func TestGetLogs(t *testing.T) {
+	app := new(commandsmocks.App)
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	events := &events{contents: []protocol.Event{
+		protocol.NewLogEvent("", "abc", time, "build", "stdout", "Building"),
+		protocol.NewLogEvent("", "abc", time, "execute", "stderr", "Oops"),
+		protocol.NewLastEvent("", "abc", time),
+	}}
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{
+		LastID: "0",
+		Filter: protocol.EventFilter{Types: []string{"log"}, Stages: []string{"build", "execute"}},
+	}).Return(events)
+
+	rr := makeRequest(app, "GET", "/runs/my-run/logs?stage=build,execute&timestamps=true&prefixes=true", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `2000-01-02T03:45:00Z [build/stdout] Building
+2000-01-02T03:45:00Z [execute/stderr] Oops
+`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, rr.Header())
+	app.AssertExpectations(t)
+}
+
+func TestGetLogsPlain(t *testing.T) {
+	app := new(commandsmocks.App)
+	iterator := new(commandsmocks.EventIterator)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Filter: protocol.EventFilter{Types: []string{"log"}}}).Return(iterator)
+	iterator.On("More").Return(true)
+	iterator.On("Close").Return(nil)
+	iterator.On("Next", mock.Anything).Return(protocol.NewLogEvent("", "abc", time.Now(), "build", "stdout", "Building"), nil).Once()
+	// The run hasn't finished yet so the logs just stop
+	iterator.On("Next", mock.Anything).Return(protocol.Event{}, io.EOF).Once()
+
+	rr := makeRequest(app, "GET", "/runs/my-run/logs", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Building\n", rr.Body.String())
+	app.AssertExpectations(t)
+	iterator.AssertExpectations(t)
+}
+
+func TestGetEventsServerSent(t *testing.T) {
+	app := new(commandsmocks.App)
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	events := &events{contents: []protocol.Event{
+		protocol.NewStartEvent("123-0", "abc", time, "build"),
+		protocol.NewLastEvent("123-1", "abc", time),
+	}}
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Follow: true}).Return(events)
+
+	rr := makeRequestWithHeader(app, "GET", "/runs/my-run/events", nil, http.Header{"Accept": []string{"text/event-stream"}})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `id: 123-0
+data: {"id":"123-0","run_id":"abc","time":"2000-01-02T03:45:00Z","type":"start","data":{"stage":"build"}}
+
+id: 123-1
+data: {"id":"123-1","run_id":"abc","time":"2000-01-02T03:45:00Z","type":"last","data":{}}
+
+`, rr.Body.String())
+	assert.Equal(t, http.Header{"Content-Type": []string{"text/event-stream"}, "Cache-Control": []string{"no-cache"}}, rr.Header())
+
+	app.AssertExpectations(t)
+}
+
+func TestGetEventsServerSentLastEventID(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "123-0", Follow: true}).Return(&events{})
+
+	rr := makeRequestWithHeader(app, "GET", "/runs/my-run/events?last_id=0", nil, http.Header{
+		"Accept":        []string{"text/event-stream"},
+		"Last-Event-Id": []string{"123-0"},
+	})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	app.AssertExpectations(t)
+}
+
 func TestDelete(t *testing.T) {
 	app := new(commandsmocks.App)
 	app.On("IsRunCreated", "my-run").Return(true, nil)
@@ -324,15 +769,75 @@ func TestDelete(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestCancel(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("CancelRun", "my-run").Return(nil)
+
+	rr := makeRequest(app, "POST", "/runs/my-run/cancel", nil)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	app.AssertExpectations(t)
+}
+
 func TestHello(t *testing.T) {
 	app := new(commandsmocks.App)
 
 	rr := makeRequest(app, "GET", "/", nil)
 
 	assert.Equal(t, http.StatusOK, rr.Code)
-	assert.Equal(t, `{"message":"Hello from Yinyo!","max_run_time":{"default":3600,"max":86400},"memory":{"default":1073741824,"max":1610612736},"version":"development","runner_image":"openaustralia/yinyo-runner:abc"}
+	assert.Equal(t, `{"message":"Hello from Yinyo!","max_run_time":{"default":3600,"max":86400},"memory":{"default":1073741824,"max":1610612736},"cpu":{"default":1000,"max":2000},"version":"development","runner_image":"openaustralia/yinyo-runner:abc"}
 `, rr.Body.String())
 	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, rr.Header())
 
 	app.AssertExpectations(t)
 }
+
+// Uses the real application with backends that don't need any external services rather than mocks
+func TestCreateRunAndUploadAppWithLocalBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yinyo-apiserver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app, err := commands.New(&commands.StartupOptions{
+		BlobStore:          "file",
+		BlobStoreDirectory: filepath.Join(dir, "store"),
+		JobDispatcher:      "local",
+		Local:              commands.LocalOptions{WorkDir: filepath.Join(dir, "work")},
+		Stream:             "memory",
+		KeyValueStore:      "memory",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := makeRequest(app, "POST", "/runs", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var run protocol.Run
+	err = json.Unmarshal(rr.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = makeRequest(app, "GET", "/runs/"+run.ID+"/app", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	appContent, err := ioutil.ReadFile("../commands/testdata/empty.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = makeRequest(app, "PUT", "/runs/"+run.ID+"/app", bytes.NewReader(appContent))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = makeRequest(app, "GET", "/runs/"+run.ID+"/app", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, appContent, rr.Body.Bytes())
+
+	rr = makeRequest(app, "DELETE", "/runs/"+run.ID, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = makeRequest(app, "GET", "/runs/"+run.ID+"/app", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,162 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/openaustralia/yinyo/pkg/commands"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// checkOrigin stops a page on another site from opening a websocket using the browser of
+// someone who has access to the server. Clients that aren't browsers don't send an Origin.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// runSocket is a websocket connection for a single run
+type runSocket struct {
+	conn *websocket.Conn
+	// Only one thing can write to the connection at a time
+	mutex sync.Mutex
+	types map[string]bool
+}
+
+func (socket *runSocket) writeJSON(v interface{}) error {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return socket.conn.WriteJSON(v)
+}
+
+func (socket *runSocket) subscribe(types []string) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.types = make(map[string]bool)
+	for _, t := range types {
+		socket.types[t] = true
+	}
+}
+
+// subscribed always lets the last event through so that the client knows there's nothing more to come
+func (socket *runSocket) subscribed(eventType string) bool {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return len(socket.types) == 0 || socket.types[eventType] || eventType == "last"
+}
+
+// runWebSocket streams the events for a run over a websocket, the same as getEvents, while
+// also accepting control messages from the client
+func (server *Server) runWebSocket(w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["id"]
+	lastID := r.URL.Query().Get("last_id")
+	if lastID == "" {
+		lastID = "0"
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded to the client so there's nothing more to do
+		log.Println(err)
+		return nil
+	}
+	defer conn.Close()
+	socket := &runSocket{conn: conn}
+
+	// This finishes on its own after the last event or when the connection is closed
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go server.sendEvents(ctx, socket, runID, lastID, eventFilter(r.URL.Query()))
+
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err)
+			}
+			return nil
+		}
+		var message protocol.ControlMessage
+		err = json.Unmarshal(b, &message)
+		if err != nil {
+			err = newHTTPError(err, http.StatusBadRequest, "JSON in message not correctly formatted")
+		} else {
+			err = server.handleControlMessage(socket, runID, message)
+		}
+		if err != nil {
+			err = socket.writeJSON(controlError(err))
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+		}
+	}
+}
+
+func (server *Server) sendEvents(ctx context.Context, socket *runSocket, runID string, lastID string, filter protocol.EventFilter) {
+	events := server.app.GetEvents(runID, commands.EventsOptions{LastID: lastID, Filter: filter, Follow: true})
+	defer events.Close()
+	for events.More() {
+		e, err := events.Next(ctx)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if err == nil && socket.subscribed(e.Type) {
+			err = socket.writeJSON(e)
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+func (server *Server) handleControlMessage(socket *runSocket, runID string, message protocol.ControlMessage) error {
+	switch message.Type {
+	case "cancel":
+		err := server.app.CancelRun(runID)
+		if err != nil {
+			return err
+		}
+		return socket.writeJSON(protocol.ControlResponse{Type: "cancelled"})
+	case "status":
+		status, err := server.app.GetStatus(runID)
+		if err != nil {
+			return err
+		}
+		return socket.writeJSON(protocol.ControlResponse{Type: "status", Status: &status})
+	case "subscribe":
+		socket.subscribe(message.Types)
+		return socket.writeJSON(protocol.ControlResponse{Type: "subscribed"})
+	default:
+		return newHTTPError(nil, http.StatusBadRequest, fmt.Sprintf("unknown control message type %q", message.Type))
+	}
+}
+
+// controlError only passes on the details of errors that are the client's fault
+func controlError(err error) protocol.ControlResponse {
+	log.Println(err)
+	var httpError *httpError
+	if errors.As(err, &httpError) {
+		return protocol.ControlResponse{Type: "error", Error: httpError.Detail}
+	}
+	return protocol.ControlResponse{Type: "error", Error: "Internal server error"}
+}
@@ -0,0 +1,162 @@
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	commandsmocks "github.com/openaustralia/yinyo/mocks/pkg/commands"
+	"github.com/openaustralia/yinyo/pkg/commands"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+func dialRunWebSocket(t *testing.T, app commands.App, path string) (*websocket.Conn, func()) {
+	server := Server{app: app}
+	server.InitialiseRoutes()
+	s := httptest.NewServer(server.router)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+path, nil)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	app := new(commandsmocks.App)
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "123", Follow: true}).Return(&events{contents: []protocol.Event{
+		protocol.NewStartEvent("124", "abc", time, "build"),
+		protocol.NewLastEvent("125", "abc", time),
+	}})
+
+	conn, cleanup := dialRunWebSocket(t, app, "/runs/my-run/websocket?last_id=123")
+	defer cleanup()
+
+	var e protocol.Event
+	assert.Nil(t, conn.ReadJSON(&e))
+	assert.Equal(t, protocol.NewStartEvent("124", "abc", time, "build"), e)
+	assert.Nil(t, conn.ReadJSON(&e))
+	assert.Equal(t, protocol.NewLastEvent("125", "abc", time), e)
+	app.AssertExpectations(t)
+}
+
+func TestWebSocketControl(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Follow: true}).Return(&events{})
+	app.On("GetStatus", "my-run").Return(protocol.RunStatus{State: "running"}, nil)
+	app.On("CancelRun", "my-run").Return(nil)
+
+	conn, cleanup := dialRunWebSocket(t, app, "/runs/my-run/websocket")
+	defer cleanup()
+
+	var response protocol.ControlResponse
+	assert.Nil(t, conn.WriteJSON(protocol.ControlMessage{Type: "status"}))
+	assert.Nil(t, conn.ReadJSON(&response))
+	assert.Equal(t, protocol.ControlResponse{Type: "status", Status: &protocol.RunStatus{State: "running"}}, response)
+
+	response = protocol.ControlResponse{}
+	assert.Nil(t, conn.WriteJSON(protocol.ControlMessage{Type: "cancel"}))
+	assert.Nil(t, conn.ReadJSON(&response))
+	assert.Equal(t, protocol.ControlResponse{Type: "cancelled"}, response)
+
+	response = protocol.ControlResponse{}
+	assert.Nil(t, conn.WriteJSON(protocol.ControlMessage{Type: "foo"}))
+	assert.Nil(t, conn.ReadJSON(&response))
+	assert.Equal(t, protocol.ControlResponse{Type: "error", Error: `unknown control message type "foo"`}, response)
+
+	response = protocol.ControlResponse{}
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	assert.Nil(t, conn.ReadJSON(&response))
+	assert.Equal(t, protocol.ControlResponse{Type: "error", Error: "JSON in message not correctly formatted"}, response)
+	app.AssertExpectations(t)
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	socket := runSocket{}
+	assert.True(t, socket.subscribed("log"))
+	socket.subscribe([]string{"start", "finish"})
+	assert.False(t, socket.subscribed("log"))
+	assert.True(t, socket.subscribed("start"))
+	assert.True(t, socket.subscribed("last"))
+	socket.subscribe(nil)
+	assert.True(t, socket.subscribed("log"))
+}
+
+// gatedEvents holds back its events until the gate is opened
+type gatedEvents struct {
+	events
+	gate chan struct{}
+}
+
+func (e *gatedEvents) Next(ctx context.Context) (protocol.Event, error) {
+	<-e.gate
+	return e.events.Next(ctx)
+}
+
+func TestWebSocketSubscribeStillSendsLast(t *testing.T) {
+	app := new(commandsmocks.App)
+	eventTime := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	gate := make(chan struct{})
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Follow: true}).Return(&gatedEvents{
+		events: events{contents: []protocol.Event{
+			protocol.NewStartEvent("124", "abc", eventTime, "build"),
+			protocol.NewLogEvent("125", "abc", eventTime, "build", "stdout", "Hello"),
+			protocol.NewLastEvent("126", "abc", eventTime),
+		}},
+		gate: gate,
+	})
+
+	conn, cleanup := dialRunWebSocket(t, app, "/runs/my-run/websocket")
+	defer cleanup()
+	// Fail rather than wait forever if the last event doesn't arrive
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var response protocol.ControlResponse
+	assert.Nil(t, conn.WriteJSON(protocol.ControlMessage{Type: "subscribe", Types: []string{"log"}}))
+	assert.Nil(t, conn.ReadJSON(&response))
+	assert.Equal(t, protocol.ControlResponse{Type: "subscribed"}, response)
+	close(gate)
+
+	var e protocol.Event
+	assert.Nil(t, conn.ReadJSON(&e))
+	assert.Equal(t, protocol.NewLogEvent("125", "abc", eventTime, "build", "stdout", "Hello"), e)
+	assert.Nil(t, conn.ReadJSON(&e))
+	assert.Equal(t, protocol.NewLastEvent("126", "abc", eventTime), e)
+	app.AssertExpectations(t)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	app := new(commandsmocks.App)
+	app.On("IsRunCreated", "my-run").Return(true, nil)
+	app.On("GetEvents", "my-run", commands.EventsOptions{LastID: "0", Follow: true}).Return(&events{})
+	server := Server{app: app}
+	server.InitialiseRoutes()
+	s := httptest.NewServer(server.router)
+	defer s.Close()
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/runs/my-run/websocket"
+
+	// A page on another site can't connect
+	_, resp, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": []string{"https://evil.example.com"}})
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// But a page served from the same host can
+	conn, _, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": []string{s.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
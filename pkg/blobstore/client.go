@@ -1,13 +1,25 @@
 package blobstore
 
 import (
+	"errors"
 	"io"
+	"net/url"
+	"time"
 )
 
 // BlobStore defines the interface to access the storage layer
 type BlobStore interface {
 	Put(path string, reader io.Reader, objectSize int64) error
-	Get(path string) (io.Reader, error)
+	Get(path string) (io.ReadCloser, error)
 	Delete(path string) error
 	IsNotExist(error) bool
+	// PresignedGetURL returns a URL that anyone can use to download the file directly from the
+	// store for the given time. It errors like Get if the file doesn't exist.
+	PresignedGetURL(path string, expiry time.Duration) (*url.URL, error)
+	// PresignedPutURL returns a URL that anyone can use to upload the file directly to the
+	// store for the given time
+	PresignedPutURL(path string, expiry time.Duration) (*url.URL, error)
 }
+
+// ErrPresignNotSupported is returned by stores that can't give out presigned URLs
+var ErrPresignNotSupported = errors.New("presigned URLs not supported")
@@ -0,0 +1,135 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type fileClient struct {
+	dir string
+}
+
+// NewFile returns an implementation of BlobStore that stores everything as files
+// inside a directory on the local filesystem
+func NewFile(dir string) (BlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &fileClient{dir: dir}, nil
+}
+
+// filePath converts a path in the store to a path on the filesystem. It makes sure that
+// the path can't point anywhere outside the directory of the store.
+func (f *fileClient) filePath(path string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+	if path == "" || filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." ||
+		strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q", path)
+	}
+	return filepath.Join(f.dir, cleaned), nil
+}
+
+// Put saves a file to the store with the given path. The file is first written
+// to a temporary file and then moved into place so that nobody sees a partially
+// written file. If objectSize is -1 the size is not checked.
+func (f *fileClient) Put(path string, reader io.Reader, objectSize int64) error {
+	p, err := f.filePath(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeAndClose(tmpfile, reader, objectSize)
+	if err != nil {
+		//nolint:errcheck // ignore error while handling an error
+		//skipcq: GSC-G104
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), p)
+}
+
+func writeAndClose(file *os.File, reader io.Reader, objectSize int64) error {
+	n, err := io.Copy(file, reader)
+	if err != nil {
+		//nolint:errcheck // ignore error while handling an error
+		//skipcq: GSC-G104
+		file.Close()
+		return err
+	}
+	if objectSize >= 0 && n != objectSize {
+		//nolint:errcheck // ignore error while handling an error
+		//skipcq: GSC-G104
+		file.Close()
+		return fmt.Errorf("expected %v bytes but got %v", objectSize, n)
+	}
+	err = file.Sync()
+	if err != nil {
+		//nolint:errcheck // ignore error while handling an error
+		//skipcq: GSC-G104
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Get retrieves a file at the given path from the store
+// It errors if the file doesn't exist
+func (f *fileClient) Get(path string) (io.ReadCloser, error) {
+	p, err := f.filePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// PresignedGetURL isn't supported because the files can only be got at through the server
+func (f *fileClient) PresignedGetURL(path string, expiry time.Duration) (*url.URL, error) {
+	return nil, ErrPresignNotSupported
+}
+
+// PresignedPutURL isn't supported because the files can only be got at through the server
+func (f *fileClient) PresignedPutURL(path string, expiry time.Duration) (*url.URL, error) {
+	return nil, ErrPresignNotSupported
+}
+
+// IsNotExist checks whether an error corresponds to an error as a result of doing a Get on
+// an object that doesn't exist
+func (f *fileClient) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// Delete removes a file in the store at the given path. Like with minio it's not an
+// error if the file doesn't exist.
+func (f *fileClient) Delete(path string) error {
+	p, err := f.filePath(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Tidy up the directory the file was in if it's now empty. If it's not
+	// empty this will fail which is what we want.
+	dir := filepath.Dir(p)
+	if dir != filepath.Clean(f.dir) {
+		//nolint:errcheck // it's fine if the directory isn't empty
+		//skipcq: GSC-G104
+		os.Remove(dir)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package blobstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTempFile(t *testing.T) (BlobStore, string) {
+	dir, err := ioutil.TempDir("", "yinyo-blobstore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func TestFilePutGetDelete(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	err := store.Put("run-name/output", strings.NewReader("output"), 6)
+	assert.Nil(t, err)
+
+	r, err := store.Get("run-name/output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "output", string(b))
+	assert.Nil(t, r.Close())
+
+	err = store.Delete("run-name/output")
+	assert.Nil(t, err)
+	_, err = store.Get("run-name/output")
+	assert.True(t, store.IsNotExist(err))
+	// The now empty directory for the run should also be gone
+	_, err = os.Stat(filepath.Join(dir, "run-name"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFilePutUnknownSize(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	err := store.Put("run-name/output", strings.NewReader("output"), -1)
+	assert.Nil(t, err)
+}
+
+func TestFilePutWrongSize(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	err := store.Put("run-name/output", strings.NewReader("output"), 10)
+	assert.EqualError(t, err, "expected 10 bytes but got 6")
+	// Nothing should have been left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "run-name"))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFileGetDoesNotExist(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	_, err := store.Get("run-name/app.tgz")
+	assert.True(t, store.IsNotExist(err))
+}
+
+func TestFileDeleteDoesNotExist(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	err := store.Delete("run-name/app.tgz")
+	assert.Nil(t, err)
+}
+
+func TestFileInvalidPath(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"", "/etc/passwd", "..", "../foo", "run-name/../../foo"} {
+		err := store.Put(path, strings.NewReader(""), 0)
+		assert.EqualError(t, err, `invalid path "`+path+`"`)
+	}
+}
+
+func TestFilePresignNotSupported(t *testing.T) {
+	store, dir := newTempFile(t)
+	defer os.RemoveAll(dir)
+
+	_, err := store.PresignedGetURL("run-name/output", time.Hour)
+	assert.True(t, errors.Is(err, ErrPresignNotSupported))
+	_, err = store.PresignedPutURL("run-name/output", time.Hour)
+	assert.True(t, errors.Is(err, ErrPresignNotSupported))
+}
@@ -3,6 +3,8 @@ package blobstore
 import (
 	"fmt"
 	"io"
+	"net/url"
+	"time"
 
 	"github.com/minio/minio-go/v6"
 	"github.com/pkg/errors"
@@ -47,18 +49,37 @@ func (m *minioClient) Put(path string, reader io.Reader, objectSize int64) error
 
 // Get retrieves a file at the given path from the store
 // It errors if the file doesn't exist
-func (m *minioClient) Get(path string) (io.Reader, error) {
+func (m *minioClient) Get(path string) (io.ReadCloser, error) {
 	object, err := m.Client.GetObject(
 		m.BucketName,
 		path,
 		minio.GetObjectOptions{},
 	)
 	if err != nil {
-		return object, err
+		return nil, err
 	}
 	// Just get the stats on the object just to see if it exists
 	_, err = object.Stat()
-	return object, err
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+// PresignedGetURL returns a URL for downloading a file directly from minio. It errors if the
+// file doesn't exist.
+func (m *minioClient) PresignedGetURL(path string, expiry time.Duration) (*url.URL, error) {
+	_, err := m.Client.StatObject(m.BucketName, path, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return m.Client.PresignedGetObject(m.BucketName, path, expiry, nil)
+}
+
+// PresignedPutURL returns a URL for uploading a file directly to minio
+func (m *minioClient) PresignedPutURL(path string, expiry time.Duration) (*url.URL, error) {
+	return m.Client.PresignedPutObject(m.BucketName, path, expiry)
 }
 
 // IsNotExist checks whether an error corresponds to an error as a result of doing a Get on
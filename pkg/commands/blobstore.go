@@ -13,7 +13,8 @@ func blobStoreStoragePath(runID string, fileName string) string {
 	return runID + "/" + fileName
 }
 
-func (app *AppImplementation) getBlobStoreData(runID string, fileName string) (io.Reader, error) {
+// getBlobStoreData returns the contents of a file in the blob store. The caller needs to close it.
+func (app *AppImplementation) getBlobStoreData(runID string, fileName string) (io.ReadCloser, error) {
 	p := blobStoreStoragePath(runID, fileName)
 	r, err := app.BlobStore.Get(p)
 	if err != nil && app.BlobStore.IsNotExist(err) {
@@ -1,17 +1,17 @@
 package commands
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -33,15 +33,26 @@ const runBinary = "/bin/wrapper"
 type App interface {
 	CreateRun(options protocol.CreateRunOptions) (protocol.Run, error)
 	DeleteRun(runID string) error
+	CancelRun(runID string) error
 	StartRun(runID string, dockerImage string, options protocol.StartRunOptions) error
-	GetApp(runID string) (io.Reader, error)
+	GetApp(runID string) (io.ReadCloser, error)
 	PutApp(runID string, reader io.Reader, objectSize int64) error
-	GetCache(runID string) (io.Reader, error)
+	GetCache(runID string) (io.ReadCloser, error)
 	PutCache(runID string, reader io.Reader, objectSize int64) error
-	GetOutput(runID string) (io.Reader, error)
+	GetOutput(runID string) (io.ReadCloser, error)
 	PutOutput(runID string, reader io.Reader, objectSize int64) error
+	// These return URLs where the app, cache and output can be got or put directly from the
+	// blob store. If presigned URLs aren't being used they return nil.
+	GetAppURL(runID string) (*url.URL, error)
+	PutAppURL(runID string) (*url.URL, error)
+	GetCacheURL(runID string) (*url.URL, error)
+	PutCacheURL(runID string) (*url.URL, error)
+	GetOutputURL(runID string) (*url.URL, error)
+	PutOutputURL(runID string) (*url.URL, error)
 	GetExitData(runID string) (protocol.ExitData, error)
-	GetEvents(runID string, lastID string) EventIterator
+	GetStatus(runID string) (protocol.RunStatus, error)
+	GetEvents(runID string, options EventsOptions) EventIterator
+	ListRuns(options ListRunsOptions) (protocol.RunsPage, error)
 	CreateEvent(runID string, event protocol.Event) error
 	IsRunCreated(runID string) (bool, error)
 	ReportAPINetworkUsage(runID string, in uint64, out uint64) error
@@ -50,7 +61,10 @@ type App interface {
 // EventIterator is the interface for getting individual events in a list of events
 type EventIterator interface {
 	More() bool
-	Next() (e protocol.Event, err error)
+	// Next waits for the next event. It gives up with the context's error when ctx is done.
+	Next(ctx context.Context) (e protocol.Event, err error)
+	// Close lets go of anything used to get at the events. Call it when you're done.
+	Close() error
 }
 
 // AppImplementation holds the state for the application
@@ -63,17 +77,66 @@ type AppImplementation struct {
 	integrationClient *integrationclient.Client
 	// This is the URL that the wrapper uses to talk back to the server API
 	ServerURL string
+	// The maximum number of runs that can be going at the same time overall and for
+	// each API key. Runs over the limit are queued. 0 means there is no limit
+	MaxRuns          int64
+	MaxRunsPerAPIKey int64
+	// How often the queue is looked at in case a run could have been started but wasn't.
+	// 0 means that the queue is only looked at when a run finishes.
+	DispatchInterval time.Duration
+	// Whether the events of a run are gzipped when they are archived to the blob store
+	CompressEvents bool
+	// The number of events read from the stream at a time. If 0 a default is used
+	EventsBatchSize int64
+	// When runs that have been abandoned are deleted
+	Reaper ReaperOptions
+	// How often things that didn't work the first time, like archiving the events of a
+	// finished run or deleting a run, are tried again. 0 means they aren't.
+	RetryInterval time.Duration
+	// If this isn't 0 clients get and put the app, cache and output directly from the blob
+	// store using presigned URLs that are valid for this long
+	PresignExpiry time.Duration
 }
 
 // StartupOptions are the options available when initialising the application
 type StartupOptions struct {
-	Minio               MinioOptions
-	Redis               RedisOptions
+	// BlobStore is either "minio" (the default) or "file"
+	BlobStore string
+	Minio     MinioOptions
+	// BlobStoreDirectory is where the files are stored when BlobStore is "file"
+	BlobStoreDirectory string
+	Redis              RedisOptions
+	// JobDispatcher is either "kubernetes" (the default) or "local"
+	JobDispatcher string
+	Local         LocalOptions
+	// Scheduling says where and how runs are scheduled on Kubernetes
+	Scheduling jobdispatcher.Scheduling
+	// Stream and KeyValueStore are either "redis" (the default) or "memory"
+	Stream              string
+	KeyValueStore       string
 	RunsNamespace       string
 	AuthenticationURL   string
 	ResourcesAllowedURL string
 	UsageURL            string
 	ServerURL           string
+	// MaxRuns and MaxRunsPerAPIKey limit how many runs can be going at the same time
+	// overall and for each API key. 0 means there is no limit
+	MaxRuns          int64
+	MaxRunsPerAPIKey int64
+	// DispatchInterval is how often the queue is looked at in case a run could have been
+	// started but wasn't, for instance because the server was restarted
+	DispatchInterval time.Duration
+	// CompressEvents gzips the events of a run when they are archived
+	CompressEvents bool
+	// EventsBatchSize is the number of events read from the stream at a time
+	EventsBatchSize int64
+	// Reaper says when runs that have been left lying around are deleted
+	Reaper ReaperOptions
+	// RetryInterval is how often things that didn't work the first time are tried again
+	RetryInterval time.Duration
+	// PresignExpiry is how long presigned URLs for the blob store are valid. 0 means that
+	// presigned URLs aren't used and everything goes through the server.
+	PresignExpiry time.Duration
 }
 
 // MinioOptions are the options for the specific blob storage
@@ -92,47 +155,126 @@ type RedisOptions struct {
 	Database int
 }
 
-// New initialises the main state of the application
-func New(startupOptions *StartupOptions) (App, error) {
-	storeAccess, err := blobstore.NewMinioClient(
-		startupOptions.Minio.Host,
-		startupOptions.Minio.Bucket,
-		startupOptions.Minio.AccessKey,
-		startupOptions.Minio.SecretKey,
-	)
-	if err != nil {
-		return nil, err
+// LocalOptions are the options for running jobs as local processes rather than on Kubernetes
+type LocalOptions struct {
+	WrapperPath  string
+	WorkDir      string
+	BuildCommand string
+	RunCommand   string
+}
+
+func newJobDispatcher(startupOptions *StartupOptions) (jobdispatcher.Jobs, error) {
+	switch startupOptions.JobDispatcher {
+	case "", "kubernetes":
+		return jobdispatcher.NewKubernetes(startupOptions.RunsNamespace, startupOptions.Scheduling)
+	case "local":
+		return jobdispatcher.NewLocal(
+			startupOptions.Local.WrapperPath,
+			startupOptions.Local.WorkDir,
+			startupOptions.Local.BuildCommand,
+			startupOptions.Local.RunCommand,
+		)
+	default:
+		return nil, fmt.Errorf("unknown job dispatcher %v", startupOptions.JobDispatcher)
 	}
+}
+
+func newBlobStore(startupOptions *StartupOptions) (blobstore.BlobStore, error) {
+	switch startupOptions.BlobStore {
+	case "", "minio":
+		return blobstore.NewMinioClient(
+			startupOptions.Minio.Host,
+			startupOptions.Minio.Bucket,
+			startupOptions.Minio.AccessKey,
+			startupOptions.Minio.SecretKey,
+		)
+	case "file":
+		if startupOptions.PresignExpiry != 0 {
+			return nil, fmt.Errorf("blob store: %w", blobstore.ErrPresignNotSupported)
+		}
+		return blobstore.NewFile(startupOptions.BlobStoreDirectory)
+	default:
+		return nil, fmt.Errorf("unknown blob store %v", startupOptions.BlobStore)
+	}
+}
+
+func usesRedis(backend string) bool {
+	return backend == "" || backend == "redis"
+}
 
-	// Connect to redis and initially just check that we can connect
+// Connect to redis and initially just check that we can connect
+func newRedisClient(options *RedisOptions) (*redis.Client, error) {
 	var tlsConfig *tls.Config
-	if startupOptions.Redis.TLS {
+	if options.TLS {
 		tlsConfig = &tls.Config{}
 	}
 	redisClient := redis.NewClient(&redis.Options{
-		Addr:      startupOptions.Redis.Address,
-		Password:  startupOptions.Redis.Password,
+		Addr:      options.Address,
+		Password:  options.Password,
 		TLSConfig: tlsConfig,
-		DB:        startupOptions.Redis.Database,
+		DB:        options.Database,
 	})
-	_, err = redisClient.Ping().Result()
+	_, err := redisClient.Ping().Result()
+	return redisClient, err
+}
+
+func newStream(backend string, redisClient *redis.Client) (stream.Stream, error) {
+	switch backend {
+	case "", "redis":
+		return stream.NewRedis(redisClient), nil
+	case "memory":
+		return stream.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown stream %v", backend)
+	}
+}
+
+func newKeyValueStore(backend string, redisClient *redis.Client) (keyvaluestore.KeyValueStore, error) {
+	switch backend {
+	case "", "redis":
+		return keyvaluestore.NewRedis(redisClient), nil
+	case "memory":
+		return keyvaluestore.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown key value store %v", backend)
+	}
+}
+
+// New initialises the main state of the application
+func New(startupOptions *StartupOptions) (App, error) {
+	storeAccess, err := newBlobStore(startupOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	streamClient := stream.NewRedis(redisClient)
+	// Only connect to redis if something needs it
+	var redisClient *redis.Client
+	if usesRedis(startupOptions.Stream) || usesRedis(startupOptions.KeyValueStore) {
+		redisClient, err = newRedisClient(&startupOptions.Redis)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	streamClient, err := newStream(startupOptions.Stream, redisClient)
+	if err != nil {
+		return nil, err
+	}
 
-	jobDispatcher, err := jobdispatcher.NewKubernetes(startupOptions.RunsNamespace)
+	jobDispatcher, err := newJobDispatcher(startupOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	keyValueStore := keyvaluestore.NewRedis(redisClient)
+	keyValueStore, err := newKeyValueStore(startupOptions.KeyValueStore, redisClient)
+	if err != nil {
+		return nil, err
+	}
 
 	httpClient := http.DefaultClient
 	integrationClient := integrationclient.New(httpClient, startupOptions.AuthenticationURL, startupOptions.ResourcesAllowedURL, startupOptions.UsageURL)
 
-	return &AppImplementation{
+	app := &AppImplementation{
 		BlobStore:         storeAccess,
 		JobDispatcher:     jobDispatcher,
 		Stream:            streamClient,
@@ -140,7 +282,23 @@ func New(startupOptions *StartupOptions) (App, error) {
 		HTTP:              httpClient,
 		integrationClient: integrationClient,
 		ServerURL:         startupOptions.ServerURL,
-	}, nil
+		MaxRuns:           startupOptions.MaxRuns,
+		MaxRunsPerAPIKey:  startupOptions.MaxRunsPerAPIKey,
+		DispatchInterval:  startupOptions.DispatchInterval,
+		CompressEvents:    startupOptions.CompressEvents,
+		EventsBatchSize:   startupOptions.EventsBatchSize,
+		Reaper:            startupOptions.Reaper,
+		RetryInterval:     startupOptions.RetryInterval,
+		PresignExpiry:     startupOptions.PresignExpiry,
+	}
+	err = jobDispatcher.Watch(app.handleJobFinished)
+	if err != nil {
+		return nil, err
+	}
+	app.startDispatcher()
+	app.startReaper()
+	app.startRetrier()
+	return app, nil
 }
 
 // CreateRun creates a run
@@ -148,19 +306,69 @@ func (app *AppImplementation) CreateRun(options protocol.CreateRunOptions) (prot
 	// Generate run ID using uuid
 	runID := uuid.NewV4().String()
 
-	err := app.integrationClient.Authenticate(runID, options.APIKey)
+	// Check the labels now rather than finding out they're no good when the job is created
+	err := jobdispatcher.CheckLabels(options.Labels)
 	if err != nil {
 		return protocol.Run{}, err
 	}
 
-	// Register in the key-value store that the run has been created
-	// TODO: Error if the key already exists - probably want to use redis SETNX
-	err = app.newCreatedKey(runID).set(true)
+	err = app.integrationClient.Authenticate(runID, options.APIKey)
+	if err != nil {
+		return protocol.Run{}, err
+	}
+
+	// Register in the key-value store that the run has been created. This is done atomically
+	// so that two servers can never both think that they created the same run.
+	created, err := app.newCreatedKey(runID).setIfNotExists(true)
+	if err != nil {
+		return protocol.Run{}, err
+	}
+	if !created {
+		return protocol.Run{}, fmt.Errorf("run %v: %w", runID, ErrAlreadyExists)
+	}
+	err = app.newStateKey(runID).set(stateCreated)
+	if err != nil {
+		return protocol.Run{}, err
+	}
+	err = app.recordActivity(runID)
+	if err != nil {
+		return protocol.Run{}, err
+	}
+	// So that the reaper can find the run if it's abandoned
+	err = app.newRunsKey().push(runID)
+	if err != nil {
+		return protocol.Run{}, err
+	}
+
+	// Remember which API key the run belongs to without storing the API key itself
+	if options.APIKey != "" {
+		err = app.newAPIKeyKey(runID).set(apiKeyID(options.APIKey))
+		if err != nil {
+			return protocol.Run{}, err
+		}
+	}
+	if len(options.Labels) > 0 {
+		err = app.newLabelsKey(runID).set(options.Labels)
+		if err != nil {
+			return protocol.Run{}, err
+		}
+	}
+	err = app.indexRun(runID, options.APIKey)
 	return protocol.Run{ID: runID}, err
 }
 
+// getLabels returns the labels that the run was created with
+func (app *AppImplementation) getLabels(runID string) (map[string]string, error) {
+	var labels map[string]string
+	err := app.newLabelsKey(runID).get(&labels)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return labels, err
+}
+
 // GetApp downloads the tar & gzipped application code
-func (app *AppImplementation) GetApp(runID string) (io.Reader, error) {
+func (app *AppImplementation) GetApp(runID string) (io.ReadCloser, error) {
 	return app.getBlobStoreData(runID, filenameApp)
 }
 
@@ -195,6 +403,11 @@ func (app *AppImplementation) validateArchiveToTempFile(reader io.Reader) (*os.F
 
 // PutApp uploads the tar & gzipped application code
 func (app *AppImplementation) PutApp(runID string, reader io.Reader, objectSize int64) error {
+	// The app can be replaced as many times as you like up until the run is started
+	err := app.checkState(runID, stateCreated, stateAppUploaded)
+	if err != nil {
+		return err
+	}
 	tmpfile, err := app.validateArchiveToTempFile(reader)
 	if err != nil {
 		return err
@@ -202,11 +415,19 @@ func (app *AppImplementation) PutApp(runID string, reader io.Reader, objectSize
 	defer os.Remove(tmpfile.Name())
 
 	// Now upload the contents of the temporary file
-	return app.putBlobStoreData(tmpfile, objectSize, runID, filenameApp)
+	err = app.putBlobStoreData(tmpfile, objectSize, runID, filenameApp)
+	if err != nil {
+		return err
+	}
+	err = app.transition(runID, stateAppUploaded, stateCreated, stateAppUploaded)
+	if err != nil {
+		return err
+	}
+	return app.recordActivity(runID)
 }
 
 // GetCache downloads the tar & gzipped build cache
-func (app *AppImplementation) GetCache(runID string) (io.Reader, error) {
+func (app *AppImplementation) GetCache(runID string) (io.ReadCloser, error) {
 	return app.getBlobStoreData(runID, filenameCache)
 }
 
@@ -222,7 +443,7 @@ func (app *AppImplementation) PutCache(runID string, reader io.Reader, objectSiz
 }
 
 // GetOutput downloads the scraper output
-func (app *AppImplementation) GetOutput(runID string) (io.Reader, error) {
+func (app *AppImplementation) GetOutput(runID string) (io.ReadCloser, error) {
 	return app.getBlobStoreData(runID, filenameOutput)
 }
 
@@ -267,21 +488,118 @@ func (app *AppImplementation) GetExitData(runID string) (protocol.ExitData, erro
 		return exitData, err
 	}
 	exitData.Finished = exitDataFinished
+	var reason string
+	err = app.newExitDataReasonKey(runID).get(&reason)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return exitData, err
+	}
+	exitData.Reason = reason
 	return exitData, nil
 }
 
+// GetStatus returns the current state of the run as seen by the job dispatcher
+func (app *AppImplementation) GetStatus(runID string) (protocol.RunStatus, error) {
+	labels, err := app.getLabels(runID)
+	if err != nil {
+		return protocol.RunStatus{}, err
+	}
+	status, err := app.JobDispatcher.GetStatus(runID)
+	if err != nil {
+		if errors.Is(err, jobdispatcher.ErrNotFound) {
+			state, err := app.stateWithoutJob(runID)
+			if err != nil {
+				return protocol.RunStatus{}, err
+			}
+			return protocol.RunStatus{State: state, Labels: labels}, nil
+		}
+		return protocol.RunStatus{}, err
+	}
+	return protocol.RunStatus{State: status.State, Restarts: status.Restarts, Labels: labels}, nil
+}
+
+// stateWithoutJob works out the state of a run that doesn't have a job. Either it's waiting in
+// the queue, it hasn't been started or it finished without the job, most likely because it
+// was cancelled and the job was deleted.
+func (app *AppImplementation) stateWithoutJob(runID string) (string, error) {
+	queued, err := app.isQueued(runID)
+	if err != nil {
+		return "", err
+	}
+	if queued {
+		return "queued", nil
+	}
+	state, err := app.getState(runID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if state != stateFinished {
+		return "created", nil
+	}
+	var reason string
+	err = app.newExitDataReasonKey(runID).get(&reason)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if reason == "cancelled" {
+		return "cancelled", nil
+	}
+	return "finished", nil
+}
+
 // StartRun starts the run
 func (app *AppImplementation) StartRun(runID string, dockerImage string, options protocol.StartRunOptions) error {
 	// First check that the app exists
-	_, err := app.GetApp(runID)
+	reader, err := app.GetApp(runID)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			return ErrAppNotAvailable
 		}
 		return err
 	}
+	// If the app was uploaded straight to the blob store nobody has checked it yet
+	if app.PresignExpiry != 0 {
+		err = app.validateArchive(reader)
+	}
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	if app.PresignExpiry != 0 {
+		// Now we know that the app is there and that it's fine
+		err = app.transition(runID, stateAppUploaded, stateCreated, stateAppUploaded)
+		if err != nil {
+			return err
+		}
+	}
 
-	err = app.integrationClient.ResourcesAllowed(runID, options.Memory, options.MaxRunTime)
+	err = app.integrationClient.ResourcesAllowed(runID, options.Memory, options.MaxRunTime, options.CPU)
+	if err != nil {
+		return err
+	}
+	// Check this now so that a run with scheduling that isn't allowed can be fixed and started again
+	err = app.JobDispatcher.CheckScheduling(runScheduling(options))
+	if err != nil {
+		return err
+	}
+	// This also makes sure that the run can only be started once
+	err = app.transition(runID, stateStarted, stateAppUploaded)
+	if err != nil {
+		return err
+	}
+	err = app.startJob(runID, dockerImage, options)
+	if err != nil {
+		// So that the run can be started again
+		err2 := app.transition(runID, stateAppUploaded, stateStarted)
+		if err2 != nil {
+			log.Printf("Run %v: couldn't go back to not being started: %v", runID, err2)
+		}
+	}
+	return err
+}
+
+// startJob gets the job for a run going or queues it once the run has been marked as started
+func (app *AppImplementation) startJob(runID string, dockerImage string, options protocol.StartRunOptions) error {
+	err := app.recordActivity(runID)
 	if err != nil {
 		return err
 	}
@@ -298,78 +616,237 @@ func (app *AppImplementation) StartRun(runID string, dockerImage string, options
 		return err
 	}
 
-	// Convert environment variable values to a single string that can be passed
-	// as a flag to wrapper
-	records := make([]string, 0, len(options.Env)>>1)
-	for _, v := range options.Env {
-		records = append(records, v.Name+"="+v.Value)
+	if !app.queueing() {
+		return app.createJob(runID, dockerImage, options)
 	}
-	var buf bytes.Buffer
-	w := csv.NewWriter(&buf)
-	if err := w.Write(records); err != nil {
+	admitted, err := app.acquireSlot(runID)
+	if err != nil {
 		return err
 	}
-	w.Flush()
+	if !admitted {
+		return app.queueRun(runID, dockerImage, options)
+	}
+	err = app.createJob(runID, dockerImage, options)
+	if err != nil {
+		// The run isn't going after all so let someone else have its slot
+		err2 := app.finishedWithSlot(runID)
+		if err2 != nil {
+			log.Printf("Run %v: couldn't give back its slot: %v", runID, err2)
+		}
+	}
+	return err
+}
 
-	envString := strings.TrimSpace(buf.String())
+// runScheduling is the scheduling that was chosen for an individual run
+func runScheduling(options protocol.StartRunOptions) jobdispatcher.RunScheduling {
+	return jobdispatcher.RunScheduling{
+		NodeSelector:  options.Scheduling.NodeSelector,
+		PriorityClass: options.Scheduling.PriorityClass,
+	}
+}
+
+// createJob actually gets the run going
+func (app *AppImplementation) createJob(runID string, dockerImage string, options protocol.StartRunOptions) error {
+	// The environment variables are not passed on the command line because they
+	// could contain secrets. Instead the job dispatcher makes them available to the wrapper.
+	var env map[string]string
+	if len(options.Env) > 0 {
+		env = make(map[string]string)
+		for _, v := range options.Env {
+			env[v.Name] = v.Value
+		}
+	}
 	command := []string{
 		runBinary,
 		runID,
 		"--output", options.Output,
 		"--server", app.ServerURL,
 	}
-	if envString != "" {
-		command = append(command, "--env", envString)
+	labels, err := app.getLabels(runID)
+	if err != nil {
+		return err
 	}
-	return app.JobDispatcher.Create(runID, dockerImage, command, options.MaxRunTime, options.Memory)
+	return app.JobDispatcher.Create(runID, jobdispatcher.CreateOptions{
+		DockerImage: dockerImage,
+		Command:     command,
+		Env:         env,
+		MaxRunTime:  options.MaxRunTime,
+		Memory:      options.Memory,
+		CPU:         options.CPU,
+		Scheduling:  runScheduling(options),
+		Labels:      labels,
+	})
+}
+
+// EventsOptions control which events GetEvents returns
+type EventsOptions struct {
+	// Use "0" for LastID to start at the beginning of the stream. Otherwise use the id of the
+	// last seen event to restart the stream from that point.
+	LastID string
+	// Only events that match Filter are returned except for the last event which is always
+	// returned so that you know when you've got to the end
+	Filter protocol.EventFilter
+	// If Follow is true new events are waited for until the run is finished. Otherwise only
+	// the events that exist when the first event is read are returned.
+	Follow bool
+	// If Limit isn't 0 no more than this number of events are returned
+	Limit int
 }
 
-// Events is an iterator to retrieve events from a stream
+// Events is an iterator to retrieve events from a stream or, once the run has finished, from
+// the archive of the stream
 type Events struct {
-	app    *AppImplementation
-	runID  string
-	lastID string
-	more   bool
+	app     *AppImplementation
+	runID   string
+	options EventsOptions
+	more    bool
+	checked bool
+	archive *json.Decoder
+	// What needs to be closed when we're done with the archive
+	archiveCloser io.Closer
+	// When not following this is the id of the last event to return
+	endID string
+	// Events that have been read from the stream but not yet returned
+	buffer []protocol.Event
+	// The number of events returned so far
+	count int
 }
 
 // GetEvents returns an iterator to get at all the events.
-// Use "0" for lastId to start at the beginning of the stream. Otherwise use the id of the last
-// seen event to restart the stream from that point. Don't try to restart the stream from the
-// last event, otherwise More() will just wait around forever.
-func (app *AppImplementation) GetEvents(runID string, lastID string) EventIterator {
-	return &Events{app: app, runID: runID, lastID: lastID, more: true}
+// Don't try to restart a followed stream from the last event, otherwise More() will just
+// wait around forever. This works the same whether the events are still in the stream or
+// have been archived.
+func (app *AppImplementation) GetEvents(runID string, options EventsOptions) EventIterator {
+	return &Events{app: app, runID: runID, options: options, more: true}
 }
 
 // More checks whether there are more events available. If true you can then call Next()
 func (events *Events) More() bool {
-	return events.more
+	return events.more && (events.options.Limit == 0 || events.count < events.options.Limit)
+}
+
+// Close lets go of the archive if it was opened
+func (events *Events) Close() error {
+	if events.archiveCloser == nil {
+		return nil
+	}
+	err := events.archiveCloser.Close()
+	events.archiveCloser = nil
+	return err
+}
+
+// Next returns the next event that matches the filter. When not following it returns io.EOF
+// if it runs out of events before finding one that matches.
+func (events *Events) Next(ctx context.Context) (e protocol.Event, err error) {
+	for {
+		e, err = events.next(ctx)
+		if err != nil {
+			return
+		}
+		if _, ok := e.Data.(protocol.LastData); ok || events.options.Filter.Matches(e) {
+			events.count++
+			return
+		}
+		if !events.more {
+			return protocol.Event{}, io.EOF
+		}
+	}
 }
 
-// Next returns the next event
-func (events *Events) Next() (e protocol.Event, err error) {
-	e, err = events.app.Stream.Get(events.runID, events.lastID)
+func (events *Events) next(ctx context.Context) (e protocol.Event, err error) {
+	// Only check for an archive (and where the end is) the first time so that we're not
+	// doing it for every event
+	if !events.checked {
+		err = events.start()
+		if err != nil {
+			return
+		}
+	}
+	if !events.more {
+		return e, io.EOF
+	}
+	if events.archive != nil {
+		e, err = events.nextFromArchive()
+	} else {
+		e, err = events.nextFromStream(ctx)
+	}
 	if err != nil {
 		return
 	}
 
 	// Add the id to the event
-	events.lastID = e.ID
+	events.options.LastID = e.ID
 
 	// Check if this is the last event
 	_, ok := e.Data.(protocol.LastData)
-	events.more = !ok
+	events.more = !ok && e.ID != events.endID
+	return
+}
+
+func (events *Events) start() (err error) {
+	events.archive, events.archiveCloser, err = events.app.openEventsArchive(events.runID)
+	if err != nil {
+		return
+	}
+	// An archive always finishes with the last event so we only need to know where the
+	// end is when reading from the stream
+	if events.archive == nil && !events.options.Follow {
+		events.endID, err = events.app.Stream.LastID(events.runID)
+		if err != nil {
+			return
+		}
+		events.more, err = eventIDsAfter(events.endID, events.options.LastID)
+		if err != nil {
+			return
+		}
+	}
+	events.checked = true
+	return
+}
+
+// nextFromStream reads events from the stream in batches
+func (events *Events) nextFromStream(ctx context.Context) (e protocol.Event, err error) {
+	if len(events.buffer) == 0 {
+		events.buffer, err = events.app.Stream.Get(ctx, events.runID, events.options.LastID, events.app.eventsBatchSize())
+		if err != nil {
+			return
+		}
+	}
+	e = events.buffer[0]
+	events.buffer = events.buffer[1:]
 	return
 }
 
 // CreateEvent add an event to the stream
 func (app *AppImplementation) CreateEvent(runID string, event protocol.Event) error {
+	// Nothing can come after the last event
+	var err error
+	if _, ok := event.Data.(protocol.LastData); ok {
+		err = app.transition(runID, stateFinished, stateCreated, stateAppUploaded, stateStarted)
+	} else {
+		err = app.checkState(runID, stateCreated, stateAppUploaded, stateStarted)
+	}
+	if err != nil {
+		return err
+	}
+	// A run that is sending events is still alive
+	err = app.recordActivity(runID)
+	if err != nil {
+		return err
+	}
 	// TODO: Use something like runID-events instead for the stream name
-	event, err := app.Stream.Add(runID, event)
+	event, err = app.Stream.Add(runID, event)
 	if err != nil {
 		return err
 	}
 	// If this is a start, finish or last event do some extra special handling
 	switch f := event.Data.(type) {
+	case protocol.StartData:
+		// Record the stage in progress so that we know what to finish if the run dies
+		err = app.newStageKey(runID).set(f.Stage)
+		if err != nil {
+			return err
+		}
 	case protocol.FirstData:
 		// Record the time that this was started
 		err = app.newFirstTimeKey(runID).set(event.Time)
@@ -390,16 +867,25 @@ func (app *AppImplementation) CreateEvent(runID string, event protocol.Event) er
 		if err != nil {
 			return err
 		}
-		// Now determine how long the container was alive for and report back
-		var firstTime time.Time
+		if f.Reason != "" {
+			err = app.newExitDataReasonKey(runID).set(f.Reason)
+			if err != nil {
+				return err
+			}
+		}
+		// Now determine how long the container was alive for and report back.
+		// If the run died before it could send the first event we don't know
+		// so we treat it as not having run at all.
+		firstTime := event.Time
 		err = app.newFirstTimeKey(runID).get(&firstTime)
-		if err != nil {
+		if err != nil && !errors.Is(err, ErrNotFound) {
 			return err
 		}
-		// We also need the amount of memory allocated during the run
+		// We also need the amount of memory allocated during the run. If the run
+		// was never started (and then cancelled) there isn't any.
 		var memory int64
 		err = app.newMemoryKey(runID).get(&memory)
-		if err != nil {
+		if err != nil && !errors.Is(err, ErrNotFound) {
 			return err
 		}
 
@@ -409,36 +895,78 @@ func (app *AppImplementation) CreateEvent(runID string, event protocol.Event) er
 		if err != nil {
 			return err
 		}
+		// Let the next run in the queue go
+		err = app.finishedWithSlot(runID)
+		if err != nil {
+			return err
+		}
+		// Nothing more should be added to the stream so we can move it out of redis. That can
+		// take a while so it's done in the background. Until it's done the events are all still
+		// in the stream.
+		go app.archiveEventsInBackground(runID, event.ID)
 	}
 	// We're intentionally doing the callback synchronously with the create event API call.
 	// This way we can ensure that events within a run maintain their ordering.
 	return app.postCallbackEvent(runID, event)
 }
 
-// DeleteRun deletes the run. Should be the last thing called
-// TODO: If one delete operation fails the rest should still be attempted
-func (app *AppImplementation) DeleteRun(runID string) error {
-	err := app.JobDispatcher.Delete(runID)
+// CancelRun stops the run but unlike DeleteRun keeps everything associated with it around. So, the
+// events, exit data and anything uploaded by the run can still be looked at afterwards.
+func (app *AppImplementation) CancelRun(runID string) error {
+	// If it's still waiting in the queue make sure it never gets started
+	err := app.newQueuedKey(runID).delete()
 	if err != nil {
 		return err
 	}
-	err = app.deleteBlobStoreData(runID, filenameApp)
+	// Finish the run before stopping the job. Deleting the job happens in the background so
+	// it can carry on sending events for a little while. Once the run has finished those are
+	// rejected. The job is stopped even if finishing the run didn't work.
+	var errs errorList
+	errs.add(app.finishRun(runID, "cancelled"))
+	errs.add(app.JobDispatcher.Delete(runID))
+	if len(errs) > 0 {
+		return fmt.Errorf("run %v: couldn't cancel: %w", runID, errs)
+	}
+	return nil
+}
+
+// DeleteRun deletes the run. Should be the last thing called. Everything is attempted even if
+// some of it fails. In that case the run is left in the "deleting" state so that it can be
+// deleted again. It's also tried again later in the background.
+func (app *AppImplementation) DeleteRun(runID string) error {
+	// Stop anything else happening to the run while it's being deleted
+	err := app.newStateKey(runID).set(stateDeleting)
 	if err != nil {
 		return err
 	}
-	err = app.deleteBlobStoreData(runID, filenameOutput)
+	var errs errorList
+	errs.add(app.JobDispatcher.Delete(runID))
+	// If the run never got to finish properly it might still be holding a slot
+	errs.add(app.finishedWithSlot(runID))
+	errs.add(app.deleteBlobStoreData(runID, filenameApp))
+	errs.add(app.deleteBlobStoreData(runID, filenameOutput))
+	errs.add(app.deleteBlobStoreData(runID, filenameCache))
+	// This needs the events archive key so do it before the keys are deleted
+	errs.add(app.deleteEventsArchive(runID))
+	errs.add(app.Stream.Delete(runID))
+	errs.add(app.deleteAllKeys(runID))
+	if len(errs) > 0 {
+		return fmt.Errorf("run %v: couldn't delete everything: %w", runID, errs)
+	}
+	// Only now that everything else has gone do we forget that the run exists
+	err = app.unindexRun(runID)
 	if err != nil {
 		return err
 	}
-	err = app.deleteBlobStoreData(runID, filenameCache)
+	err = app.newAPIKeyKey(runID).delete()
 	if err != nil {
 		return err
 	}
-	err = app.deleteAllKeys(runID)
+	err = app.newStateKey(runID).delete()
 	if err != nil {
 		return err
 	}
-	return app.Stream.Delete(runID)
+	return app.newCreatedKey(runID).delete()
 }
 
 func (app *AppImplementation) IsRunCreated(runID string) (bool, error) {
@@ -476,14 +1004,20 @@ func (app *AppImplementation) postCallback(url string, data interface{}) (int, e
 }
 
 func (app *AppImplementation) postCallbackEvent(runID string, event protocol.Event) error {
+	// If the run was never started there won't be a callback URL
 	var callbackURL string
 	err := app.newCallbackKey(runID).get(&callbackURL)
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return err
 	}
 
 	// Only do the callback if there's a sensible URL
 	if callbackURL != "" {
+		// So that whoever gets the callback knows which of their runs it's about
+		event.Labels, err = app.getLabels(runID)
+		if err != nil {
+			return err
+		}
 		size, err := app.postCallback(callbackURL, event)
 		// Record amount written even if there was an error
 		if size > 0 {
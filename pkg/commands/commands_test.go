@@ -1,7 +1,9 @@
 package commands
 
 import (
+	"context"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -18,9 +20,12 @@ import (
 	jobdispatchermocks "github.com/openaustralia/yinyo/mocks/pkg/jobdispatcher"
 	keyvaluestoremocks "github.com/openaustralia/yinyo/mocks/pkg/keyvaluestore"
 	streammocks "github.com/openaustralia/yinyo/mocks/pkg/stream"
+	"github.com/openaustralia/yinyo/pkg/blobstore"
 	"github.com/openaustralia/yinyo/pkg/integrationclient"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
 	"github.com/openaustralia/yinyo/pkg/keyvaluestore"
 	"github.com/openaustralia/yinyo/pkg/protocol"
+	"github.com/openaustralia/yinyo/pkg/stream"
 )
 
 func TestStoragePath(t *testing.T) {
@@ -34,20 +39,29 @@ func TestStartRun(t *testing.T) {
 	blobStore := new(blobstoremocks.BlobStore)
 
 	// Expect that the job will get dispatched
-	job.On(
-		"Create",
-		"run-name",
-		"image",
-		[]string{"/bin/wrapper", "run-name", "--output", "output.txt", "--server", "http://localhost:8080", "--env", "FOO=bar"},
-		int64(86400),
-		int64(512*1024*1024),
-	).Return(nil)
+	job.On("CheckScheduling", jobdispatcher.RunScheduling{NodeSelector: map[string]string{"size": "large"}}).Return(nil)
+	job.On("Create", "run-name", jobdispatcher.CreateOptions{
+		DockerImage: "image",
+		Command:     []string{"/bin/wrapper", "run-name", "--output", "output.txt", "--server", "http://localhost:8080"},
+		Env:         map[string]string{"FOO": "bar"},
+		MaxRunTime:  86400,
+		Memory:      512 * 1024 * 1024,
+		CPU:         1000,
+		Scheduling:  jobdispatcher.RunScheduling{NodeSelector: map[string]string{"size": "large"}},
+		Labels:      map[string]string{"scraper": "planningalerts"},
+	}).Return(nil)
+	// Expect that the labels the run was created with are put on the job
+	keyValueStore.On("Get", "run-name/labels").Return(`{"scraper":"planningalerts"}`, nil)
 	// Expect that we save the callback url in the key value store
 	keyValueStore.On("Set", "run-name/url", `"http://foo.com"`).Return(nil)
 	// Expect that we save away the amount of memory allocated to the run
 	keyValueStore.On("Set", "run-name/memory", "536870912").Return(nil)
 	// Expect that we try to get the code just to see if it exists
-	blobStore.On("Get", "run-name/app.tgz").Return(nil, nil)
+	blobStore.On("Get", "run-name/app.tgz").Return(ioutil.NopCloser(strings.NewReader("")), nil)
+	// Expect that the run moves on from having its app uploaded to being started
+	keyValueStore.On("Get", "run-name/state").Return(`"app_uploaded"`, nil)
+	keyValueStore.On("CompareAndSet", "run-name/state", `"app_uploaded"`, `"started"`).Return(true, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
 
 	app := AppImplementation{integrationClient: &integrationclient.Client{}, JobDispatcher: job, KeyValueStore: keyValueStore, BlobStore: blobStore, ServerURL: "http://localhost:8080"}
 	err := app.StartRun(
@@ -59,6 +73,8 @@ func TestStartRun(t *testing.T) {
 			Callback:   protocol.Callback{URL: "http://foo.com"},
 			MaxRunTime: 86400,
 			Memory:     512 * 1024 * 1024,
+			CPU:        1000,
+			Scheduling: protocol.Scheduling{NodeSelector: map[string]string{"size": "large"}},
 		},
 	)
 	assert.Nil(t, err)
@@ -83,13 +99,20 @@ func TestCreateEvent(t *testing.T) {
 
 	time := time.Now()
 	stream.On("Add", "run-name", protocol.NewStartEvent("", "abc", time, "build")).Return(protocol.NewStartEvent("123", "abc", time, "build"), nil)
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
 	keyValueStore.On("Get", "run-name/url").Return(`"http://foo.com/bar"`, nil)
+	keyValueStore.On("Get", "run-name/labels").Return(`{"scraper":"planningalerts"}`, nil)
+	keyValueStore.On("Set", "run-name/stage", `"build"`).Return(nil)
 
 	// Mock out the http RoundTripper so that no actual http request is made
 	httpClient := http.DefaultClient
 	roundTripper := new(MockRoundTripper)
 	roundTripper.On("RoundTrip", mock.MatchedBy(func(r *http.Request) bool {
-		return r.URL.String() == "http://foo.com/bar"
+		body, err := ioutil.ReadAll(r.Body)
+		// The labels of the run should be sent along with the event
+		return err == nil && r.URL.String() == "http://foo.com/bar" &&
+			strings.Contains(string(body), `"labels":{"scraper":"planningalerts"}`)
 	})).Return(
 		&http.Response{
 			StatusCode: http.StatusOK,
@@ -119,6 +142,8 @@ func TestCreateFinishEvent(t *testing.T) {
 	eventWithID := protocol.NewFinishEvent("123", "abc", time, "build", exitData)
 
 	stream.On("Add", "run-name", event).Return(eventWithID, nil)
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
 	keyValueStore.On("Get", "run-name/url").Return("", nil)
 	keyValueStore.On("Set", "run-name/exit_data/build", `{"exit_code":12,"usage":{"max_rss":100,"network_in":200,"network_out":300}}`).Return(nil)
 
@@ -138,6 +163,8 @@ func TestCreateFirstEvent(t *testing.T) {
 	eventWithID := protocol.NewFirstEvent("123", "abc", time)
 
 	stream.On("Add", "run-name", event).Return(eventWithID, nil)
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
 	keyValueStore.On("Set", "run-name/first_time", `"2020-03-11T15:24:30Z"`).Return(nil)
 	keyValueStore.On("Get", "run-name/url").Return("", nil)
 
@@ -150,22 +177,40 @@ func TestCreateFirstEvent(t *testing.T) {
 func TestCreateLastEvent(t *testing.T) {
 	stream := new(streammocks.Stream)
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
-	app := AppImplementation{integrationClient: &integrationclient.Client{}, Stream: stream, KeyValueStore: keyValueStore}
+	blobStore := new(blobstoremocks.BlobStore)
+	app := AppImplementation{integrationClient: &integrationclient.Client{}, Stream: stream, KeyValueStore: keyValueStore, BlobStore: blobStore}
 
-	time := time.Now()
-	event := protocol.NewLastEvent("", "abc", time)
-	eventWithID := protocol.NewLastEvent("123", "abc", time)
+	now := time.Now()
+	event := protocol.NewLastEvent("", "abc", now)
+	eventWithID := protocol.NewLastEvent("123", "abc", now)
 
 	stream.On("Add", "run-name", event).Return(eventWithID, nil)
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
 	keyValueStore.On("Get", "run-name/url").Return("", nil)
 	keyValueStore.On("Get", "run-name/first_time").Return(`"2020-03-11T15:24:30Z"`, nil)
+	keyValueStore.On("CompareAndSet", "run-name/state", `"started"`, `"finished"`).Return(true, nil)
 	keyValueStore.On("Set", "run-name/exit_data/finished", `true`).Return(nil)
 	keyValueStore.On("Get", "run-name/memory").Return("1073741824", nil)
+	keyValueStore.On("CompareAndSet", "run-name/slot", `true`, `false`).Return(false, nil)
+	// The events get archived
+	stream.On("Get", mock.Anything, "run-name", "0", int64(100)).Return([]protocol.Event{eventWithID}, nil)
+	blobStore.On("Put", "run-name/events.ndjson", mock.Anything, mock.Anything).Return(nil)
+	keyValueStore.On("Set", "run-name/events_archive", `"events.ndjson"`).Return(nil)
+	// The last thing archiving does
+	archived := make(chan struct{})
+	stream.On("Expire", "run-name", eventsStreamExpiry).Return(nil).Run(func(mock.Arguments) { close(archived) })
 
 	app.CreateEvent("run-name", event)
+	select {
+	case <-archived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events weren't archived")
+	}
 
 	stream.AssertExpectations(t)
 	keyValueStore.AssertExpectations(t)
+	blobStore.AssertExpectations(t)
 }
 
 func TestCreateEventNoCallbackURL(t *testing.T) {
@@ -174,6 +219,9 @@ func TestCreateEventNoCallbackURL(t *testing.T) {
 
 	time := time.Now()
 	stream.On("Add", "run-name", protocol.NewStartEvent("", "abc", time, "build")).Return(protocol.NewStartEvent("123", "abc", time, "build"), nil)
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
+	keyValueStore.On("Set", "run-name/stage", `"build"`).Return(nil)
 	keyValueStore.On("Get", "run-name/url").Return(`""`, nil)
 
 	// Mock out the http RoundTripper so that no actual http request is made
@@ -195,8 +243,12 @@ func TestCreateEventErrorOneTimeDuringCallback(t *testing.T) {
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
 
 	time := time.Now()
-	stream.On("Add", "run-name", protocol.NewStartEvent("", "abc", time, "build")).Return(protocol.NewStartEvent("123", "abc", time, "build"), nil)
+	stream.On("Add", "run-name", protocol.NewStartEvent("", "abc", time, "build")).Return(protocol.NewStartEvent("123", "abc", time, "build"), nil).Once()
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
+	keyValueStore.On("Set", "run-name/stage", `"build"`).Return(nil).Once()
 	keyValueStore.On("Get", "run-name/url").Return(`"http://foo.com/bar"`, nil)
+	keyValueStore.On("Get", "run-name/labels").Return("", keyvaluestore.ErrKeyNotExist)
 
 	// Mock out the http RoundTripper so that no actual http request is made
 	httpClient := http.DefaultClient
@@ -235,8 +287,12 @@ func TestCreateEventErrorFiveTimesDuringCallback(t *testing.T) {
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
 
 	time := time.Now()
-	stream.On("Add", "run-name", protocol.NewStartEvent("", "abc", time, "build")).Return(protocol.NewStartEvent("123", "abc", time, "build"), nil)
+	stream.On("Add", "run-name", protocol.NewStartEvent("", "abc", time, "build")).Return(protocol.NewStartEvent("123", "abc", time, "build"), nil).Once()
+	keyValueStore.On("Get", "run-name/state").Return(`"started"`, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
+	keyValueStore.On("Set", "run-name/stage", `"build"`).Return(nil).Once()
 	keyValueStore.On("Get", "run-name/url").Return(`"http://foo.com/bar"`, nil)
+	keyValueStore.On("Get", "run-name/labels").Return("", keyvaluestore.ErrKeyNotExist)
 
 	// Mock out the http RoundTripper so that no actual http request is made
 	httpClient := http.DefaultClient
@@ -266,22 +322,24 @@ func TestGetEvents(t *testing.T) {
 	stream := new(streammocks.Stream)
 
 	time := time.Now()
-	stream.On("Get", "run-name", "0").Return(protocol.NewStartEvent("123", "abc", time, "build"), nil)
-	stream.On("Get", "run-name", "123").Return(protocol.NewLastEvent("456", "abc", time), nil)
+	stream.On("Get", mock.Anything, "run-name", "0", int64(100)).Return([]protocol.Event{protocol.NewStartEvent("123", "abc", time, "build")}, nil)
+	stream.On("Get", mock.Anything, "run-name", "123", int64(100)).Return([]protocol.Event{protocol.NewLastEvent("456", "abc", time)}, nil)
+	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
+	keyValueStore.On("Get", "run-name/events_archive").Return("", keyvaluestore.ErrKeyNotExist)
 
-	app := AppImplementation{Stream: stream}
+	app := AppImplementation{Stream: stream, KeyValueStore: keyValueStore}
 
-	events := app.GetEvents("run-name", "0")
+	events := app.GetEvents("run-name", EventsOptions{LastID: "0", Follow: true})
 
 	// We're expecting two events in the stream. Let's hardcode what would normally be in a loop
 	assert.True(t, events.More())
-	e, err := events.Next()
+	e, err := events.Next(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.Equal(t, protocol.NewStartEvent("123", "abc", time, "build"), e)
 	assert.True(t, events.More())
-	e, err = events.Next()
+	e, err = events.Next(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -291,24 +349,187 @@ func TestGetEvents(t *testing.T) {
 	stream.AssertExpectations(t)
 }
 
+func TestGetEventsNotFollowing(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "build", "stdout", "Building")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewStartEvent("", runID, time, "execute")))
+
+	// The run is still going but we only get what's there now
+	var types []string
+	events := app.GetEvents(runID, EventsOptions{LastID: "0"})
+	for events.More() {
+		e, err := events.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{"first", "log", "start"}, types)
+
+	// If the events at the end don't match we find out when we get there
+	events = app.GetEvents(runID, EventsOptions{LastID: "0", Filter: protocol.EventFilter{Types: []string{"log"}}})
+	e, err := events.Next(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "log", e.Type)
+	assert.True(t, events.More())
+	_, err = events.Next(context.Background())
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, events.More())
+}
+
+func TestGetEventsLimited(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "build", "stdout", "Building")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewStartEvent("", runID, time, "execute")))
+
+	// Get the events two at a time, carrying on from the last one each time
+	var types []string
+	lastID := "0"
+	for page := 0; page < 2; page++ {
+		events := app.GetEvents(runID, EventsOptions{LastID: lastID, Limit: 2})
+		for events.More() {
+			e, err := events.Next(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, e.Type)
+			lastID = e.ID
+		}
+	}
+	assert.Equal(t, []string{"first", "log", "start"}, types)
+}
+
+func TestGetEventsBatched(t *testing.T) {
+	stream := new(streammocks.Stream)
+	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
+	app := AppImplementation{Stream: stream, KeyValueStore: keyValueStore, EventsBatchSize: 2}
+
+	time := time.Now()
+	keyValueStore.On("Get", "run-name/events_archive").Return("", keyvaluestore.ErrKeyNotExist)
+	stream.On("Get", mock.Anything, "run-name", "0", int64(2)).Return([]protocol.Event{
+		protocol.NewStartEvent("123", "abc", time, "build"),
+		protocol.NewLogEvent("124", "abc", time, "build", "stdout", "Hello"),
+	}, nil).Once()
+	stream.On("Get", mock.Anything, "run-name", "124", int64(2)).Return([]protocol.Event{
+		protocol.NewLastEvent("125", "abc", time),
+	}, nil).Once()
+
+	var ids []string
+	events := app.GetEvents("run-name", EventsOptions{LastID: "0", Follow: true})
+	for events.More() {
+		e, err := events.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []string{"123", "124", "125"}, ids)
+
+	stream.AssertExpectations(t)
+	keyValueStore.AssertExpectations(t)
+}
+
+func TestGetEventsFromArchive(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		app, runID, cleanup := newStartedRunInMemory(t)
+		defer cleanup()
+		app.CompressEvents = compress
+
+		time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+		assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+		assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "execute", "stdout", "Hello")))
+		assert.Nil(t, app.CreateEvent(runID, protocol.NewLastEvent("", runID, time)))
+		streamed := getAllEvents(t, app, runID)
+		waitForEventsArchive(t, app, runID)
+
+		// Take the stream away so that the only place to get the events from is the archive
+		assert.Nil(t, app.Stream.Delete(runID))
+		assert.Equal(t, streamed, getAllEvents(t, app, runID))
+
+		// Restarting part way through
+		events := app.GetEvents(runID, EventsOptions{LastID: streamed[0].ID, Follow: true})
+		e, err := events.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, streamed[1], e)
+		assert.True(t, events.More())
+	}
+}
+
+func TestGetEventsFiltered(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "build", "stdout", "Building")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "execute", "stdout", "Hello")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "execute", "stderr", "Oops")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLastEvent("", runID, time)))
+
+	var texts []string
+	events := app.GetEvents(runID, EventsOptions{
+		LastID: "0",
+		Filter: protocol.EventFilter{Types: []string{"log"}, Stages: []string{"execute"}},
+		Follow: true,
+	})
+	for events.More() {
+		e, err := events.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, ok := e.Data.(protocol.LogData); ok {
+			texts = append(texts, l.Text)
+		} else {
+			// The last event always gets through
+			assert.Equal(t, "last", e.Type)
+		}
+	}
+	assert.Equal(t, []string{"Hello", "Oops"}, texts)
+}
+
 func TestDeleteRun(t *testing.T) {
 	jobDispatcher := new(jobdispatchermocks.Jobs)
 	blobStore := new(blobstoremocks.BlobStore)
 	stream := new(streammocks.Stream)
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
+	// Nothing else can happen to the run while it's being deleted
+	keyValueStore.On("Set", "run-name/state", `"deleting"`).Return(nil)
 
 	jobDispatcher.On("Delete", "run-name").Return(nil)
+	keyValueStore.On("CompareAndSet", "run-name/slot", `true`, `false`).Return(false, nil)
 	blobStore.On("Delete", "run-name/app.tgz").Return(nil)
 	blobStore.On("Delete", "run-name/output").Return(nil)
 	blobStore.On("Delete", "run-name/cache.tgz").Return(nil)
+	keyValueStore.On("Get", "run-name/events_archive").Return(`"events.ndjson.gz"`, nil)
+	blobStore.On("Delete", "run-name/events.ndjson.gz").Return(nil)
 	stream.On("Delete", "run-name").Return(nil)
 	keyValueStore.On("Delete", "run-name/url").Return(nil)
+	keyValueStore.On("Delete", "run-name/labels").Return(nil)
 	keyValueStore.On("Delete", "run-name/created").Return(nil)
+	keyValueStore.On("Delete", "run-name/state").Return(nil)
+	keyValueStore.On("Delete", "run-name/created_at").Return(nil)
+	keyValueStore.On("Delete", "run-name/last_activity").Return(nil)
+	keyValueStore.On("Get", "run-name/api_key").Return("", keyvaluestore.ErrKeyNotExist)
+	keyValueStore.On("SortedSetRemove", "runs/", "run-name").Return(nil)
+	keyValueStore.On("Delete", "run-name/api_key").Return(nil)
+	keyValueStore.On("Delete", "run-name/queued").Return(nil)
+	keyValueStore.On("Delete", "run-name/slot").Return(nil)
+	keyValueStore.On("Delete", "run-name/events_archive").Return(nil)
 	keyValueStore.On("Delete", "run-name/first_time").Return(nil)
+	keyValueStore.On("Delete", "run-name/stage").Return(nil)
 	keyValueStore.On("Delete", "run-name/memory").Return(nil)
 	keyValueStore.On("Delete", "run-name/exit_data/build").Return(nil)
 	keyValueStore.On("Delete", "run-name/exit_data/execute").Return(nil)
 	keyValueStore.On("Delete", "run-name/exit_data/finished").Return(nil)
+	keyValueStore.On("Delete", "run-name/exit_data/reason").Return(nil)
 
 	app := AppImplementation{
 		JobDispatcher: jobDispatcher,
@@ -325,6 +546,128 @@ func TestDeleteRun(t *testing.T) {
 	keyValueStore.AssertExpectations(t)
 }
 
+func TestDeleteRunPartlyFails(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	runID := createAndStartRun(t, app, "")
+
+	// The blob store has a temporary problem deleting one thing
+	blobStore := new(blobstoremocks.BlobStore)
+	blobStore.On("Delete", runID+"/output").Return(errors.New("connection refused")).Once()
+	blobStore.On("Delete", mock.Anything).Return(nil)
+	app.BlobStore = blobStore
+
+	err := app.DeleteRun(runID)
+	assert.EqualError(t, err, "run "+runID+": couldn't delete everything: connection refused")
+	// Everything else was still deleted
+	blobStore.AssertCalled(t, "Delete", runID+"/app.tgz")
+	blobStore.AssertCalled(t, "Delete", runID+"/cache.tgz")
+	var lastActivity time.Time
+	assert.True(t, errors.Is(app.newLastActivityKey(runID).get(&lastActivity), ErrNotFound))
+	// But the run is still there so that deleting it can be tried again
+	created, err := app.IsRunCreated(runID)
+	assert.Nil(t, err)
+	assert.True(t, created)
+	state, err := app.getState(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, "deleting", state)
+
+	// It's tried again later
+	assert.Nil(t, app.retryDeleting())
+	created, err = app.IsRunCreated(runID)
+	assert.Nil(t, err)
+	assert.False(t, created)
+}
+
+func TestCancelRun(t *testing.T) {
+	jobDispatcher := new(jobdispatchermocks.Jobs)
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+	app.JobDispatcher = jobDispatcher
+
+	// By the time the job is deleted the run has finished
+	jobDispatcher.On("Delete", runID).Run(func(args mock.Arguments) {
+		state, err := app.getState(runID)
+		assert.Nil(t, err)
+		assert.Equal(t, "finished", state)
+	}).Return(nil)
+	jobDispatcher.On("GetStatus", runID).Return(jobdispatcher.Status{}, jobdispatcher.ErrNotFound)
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewStartEvent("", runID, time, "execute")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "execute", "stdout", "Hello")))
+
+	err := app.CancelRun(runID)
+	assert.Nil(t, err)
+
+	// The events so far should still be there followed by the ones for cancelling
+	var types []string
+	for _, e := range getAllEvents(t, app, runID) {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{"first", "start", "log", "finish", "last"}, types)
+
+	// The job might still be going for a little while but anything it sends is rejected
+	err = app.CreateEvent(runID, protocol.NewLogEvent("", runID, time, "execute", "stdout", "Still here"))
+	assert.True(t, errors.Is(err, ErrInvalidState))
+
+	status, err := app.GetStatus(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.RunStatus{State: "cancelled"}, status)
+
+	e, err := app.GetExitData(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.ExitData{
+		Execute:  &protocol.ExitDataStage{ExitCode: -1},
+		Finished: true,
+		Reason:   "cancelled",
+	}, e)
+	jobDispatcher.AssertExpectations(t)
+}
+
+func TestCancelRunNotStarted(t *testing.T) {
+	jobDispatcher := new(jobdispatchermocks.Jobs)
+	blobStore := new(blobstoremocks.BlobStore)
+	app := AppImplementation{
+		integrationClient: &integrationclient.Client{},
+		JobDispatcher:     jobDispatcher,
+		BlobStore:         blobStore,
+		Stream:            stream.NewMemory(),
+		KeyValueStore:     keyvaluestore.NewMemory(),
+	}
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobDispatcher.On("Delete", run.ID).Return(nil)
+	blobStore.On("Put", run.ID+"/events.ndjson", mock.Anything, mock.Anything).Return(nil)
+
+	err = app.CancelRun(run.ID)
+	assert.Nil(t, err)
+
+	e, err := app.GetExitData(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.ExitData{Finished: true, Reason: "cancelled"}, e)
+	jobDispatcher.AssertExpectations(t)
+}
+
+func TestCancelRunFinishFails(t *testing.T) {
+	jobDispatcher := new(jobdispatchermocks.Jobs)
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+	app.JobDispatcher = jobDispatcher
+	// So that the last event can't be sent
+	app.Stream = brokenStream{app.Stream}
+
+	// The job is stopped anyway
+	jobDispatcher.On("Delete", runID).Return(nil)
+
+	err := app.CancelRun(runID)
+	assert.EqualError(t, err, "run "+runID+": couldn't cancel: stream down")
+	jobDispatcher.AssertExpectations(t)
+}
+
 func TestIsRunCreatedNotFound(t *testing.T) {
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
 	keyValueStore.On("Get", "does-not-exit/created").Return("", keyvaluestore.ErrKeyNotExist)
@@ -340,9 +683,13 @@ func TestIsRunCreatedNotFound(t *testing.T) {
 
 func TestPutApp(t *testing.T) {
 	blobStore := new(blobstoremocks.BlobStore)
-	app := AppImplementation{BlobStore: blobStore}
+	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
+	app := AppImplementation{BlobStore: blobStore, KeyValueStore: keyValueStore}
 
 	blobStore.On("Put", "run-name/app.tgz", mock.Anything, mock.Anything).Return(nil)
+	keyValueStore.On("Get", "run-name/state").Return(`"created"`, nil)
+	keyValueStore.On("CompareAndSet", "run-name/state", `"created"`, `"app_uploaded"`).Return(true, nil)
+	keyValueStore.On("Set", "run-name/last_activity", mock.Anything).Return(nil)
 
 	// Open a file which has the simplest possible archive which is empty but valid
 	file, _ := os.Open("testdata/empty.tgz")
@@ -355,6 +702,7 @@ func TestPutApp(t *testing.T) {
 	}
 
 	blobStore.AssertExpectations(t)
+	keyValueStore.AssertExpectations(t)
 }
 
 func TestGetCache(t *testing.T) {
@@ -396,7 +744,7 @@ func TestGetOutput(t *testing.T) {
 	blobStore := new(blobstoremocks.BlobStore)
 	app := AppImplementation{BlobStore: blobStore}
 
-	blobStore.On("Get", "run-name/output").Return(strings.NewReader("output"), nil)
+	blobStore.On("Get", "run-name/output").Return(ioutil.NopCloser(strings.NewReader("output")), nil)
 
 	r, err := app.GetOutput("run-name")
 	if err != nil {
@@ -429,6 +777,7 @@ func TestGetExitData(t *testing.T) {
 	keyValueStore.On("Get", "run-name/exit_data/build").Return(`{"exit_code":0,"usage":{"max_rss":1,"network_in":0,"network_out":0}}`, nil)
 	keyValueStore.On("Get", "run-name/exit_data/execute").Return(`{"exit_code":0,"usage":{"max_rss":2,"network_in":0,"network_out":0}}`, nil)
 	keyValueStore.On("Get", "run-name/exit_data/finished").Return("true", nil)
+	keyValueStore.On("Get", "run-name/exit_data/reason").Return("", keyvaluestore.ErrKeyNotExist)
 	e, err := app.GetExitData("run-name")
 	if err != nil {
 		t.Fatal(err)
@@ -450,6 +799,7 @@ func TestGetExitDataBuildErrored(t *testing.T) {
 	keyValueStore.On("Get", "run-name/exit_data/build").Return(`{"exit_code":15,"usage":{"max_rss":0,"network_in":0,"network_out":0}}`, nil)
 	keyValueStore.On("Get", "run-name/exit_data/execute").Return("", keyvaluestore.ErrKeyNotExist)
 	keyValueStore.On("Get", "run-name/exit_data/finished").Return("true", nil)
+	keyValueStore.On("Get", "run-name/exit_data/reason").Return("", keyvaluestore.ErrKeyNotExist)
 
 	e, err := app.GetExitData("run-name")
 	if err != nil {
@@ -471,6 +821,7 @@ func TestGetExitDataRunNotStarted(t *testing.T) {
 	keyValueStore.On("Get", "run-name/exit_data/build").Return("", keyvaluestore.ErrKeyNotExist)
 	keyValueStore.On("Get", "run-name/exit_data/execute").Return("", keyvaluestore.ErrKeyNotExist)
 	keyValueStore.On("Get", "run-name/exit_data/finished").Return("", keyvaluestore.ErrKeyNotExist)
+	keyValueStore.On("Get", "run-name/exit_data/reason").Return("", keyvaluestore.ErrKeyNotExist)
 
 	e, err := app.GetExitData("run-name")
 	if err != nil {
@@ -484,11 +835,49 @@ func TestGetExitDataRunNotStarted(t *testing.T) {
 	keyValueStore.AssertExpectations(t)
 }
 
+func TestGetStatus(t *testing.T) {
+	job := new(jobdispatchermocks.Jobs)
+	app := AppImplementation{JobDispatcher: job, KeyValueStore: keyvaluestore.NewMemory()}
+
+	job.On("GetStatus", "run-name").Return(jobdispatcher.Status{State: jobdispatcher.StateRunning, Restarts: 2}, nil)
+	err := app.newLabelsKey("run-name").set(map[string]string{"scraper": "planningalerts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := app.GetStatus("run-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, protocol.RunStatus{State: "running", Restarts: 2, Labels: map[string]string{"scraper": "planningalerts"}}, status)
+	job.AssertExpectations(t)
+}
+
+func TestGetStatusRunNotStarted(t *testing.T) {
+	job := new(jobdispatchermocks.Jobs)
+	app := AppImplementation{JobDispatcher: job, KeyValueStore: keyvaluestore.NewMemory()}
+
+	job.On("GetStatus", "run-name").Return(jobdispatcher.Status{}, jobdispatcher.ErrNotFound)
+
+	status, err := app.GetStatus("run-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, protocol.RunStatus{State: "created"}, status)
+	job.AssertExpectations(t)
+}
+
 func TestCreateRun(t *testing.T) {
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
 	app := AppImplementation{integrationClient: &integrationclient.Client{}, KeyValueStore: keyValueStore}
 
-	keyValueStore.On("Set", mock.Anything, mock.Anything).Return(nil)
+	keyValueStore.On("SetIfNotExists", mock.Anything, "true").Return(true, nil)
+	keyValueStore.On("Set", mock.Anything, `"created"`).Return(nil)
+	keyValueStore.On("Set", mock.MatchedBy(func(key string) bool { return strings.HasSuffix(key, "/last_activity") }), mock.Anything).Return(nil)
+	keyValueStore.On("ListPush", "runs", mock.Anything).Return(nil)
+	keyValueStore.On("Set", mock.MatchedBy(func(key string) bool { return strings.HasSuffix(key, "/created_at") }), mock.Anything).Return(nil)
+	keyValueStore.On("Increment", "run_count", int64(1)).Return(int64(1), nil)
+	keyValueStore.On("SortedSetAdd", "runs/", mock.Anything, int64(1)).Return(nil)
 
 	run, err := app.CreateRun(protocol.CreateRunOptions{})
 	if err != nil {
@@ -500,6 +889,18 @@ func TestCreateRun(t *testing.T) {
 	keyValueStore.AssertExpectations(t)
 }
 
+func TestCreateRunAlreadyExists(t *testing.T) {
+	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
+	app := AppImplementation{integrationClient: &integrationclient.Client{}, KeyValueStore: keyValueStore}
+
+	// Somehow another server has already created a run with the same ID
+	keyValueStore.On("SetIfNotExists", mock.Anything, "true").Return(false, nil)
+
+	_, err := app.CreateRun(protocol.CreateRunOptions{})
+	assert.True(t, errors.Is(err, ErrAlreadyExists))
+	keyValueStore.AssertExpectations(t)
+}
+
 func TestCreateRunWithAuthenticationAllowed(t *testing.T) {
 	keyValueStore := new(keyvaluestoremocks.KeyValueStore)
 
@@ -526,7 +927,16 @@ func TestCreateRunWithAuthenticationAllowed(t *testing.T) {
 		nil,
 	)
 
-	keyValueStore.On("Set", mock.Anything, "true").Return(nil)
+	keyValueStore.On("SetIfNotExists", mock.Anything, "true").Return(true, nil)
+	keyValueStore.On("Set", mock.Anything, `"created"`).Return(nil)
+	keyValueStore.On("Set", mock.MatchedBy(func(key string) bool { return strings.HasSuffix(key, "/last_activity") }), mock.Anything).Return(nil)
+	keyValueStore.On("ListPush", "runs", mock.Anything).Return(nil)
+	keyValueStore.On("Set", mock.MatchedBy(func(key string) bool { return strings.HasSuffix(key, "/created_at") }), mock.Anything).Return(nil)
+	// The run is indexed under the hashed API key too
+	keyValueStore.On("Increment", "run_count", int64(1)).Return(int64(1), nil)
+	keyValueStore.On("SortedSetAdd", "runs/c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2", mock.Anything, int64(1)).Return(nil)
+	// The API key is only stored hashed
+	keyValueStore.On("Set", mock.Anything, `"c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2"`).Return(nil)
 
 	_, err := app.CreateRun(protocol.CreateRunOptions{APIKey: "foobar"})
 	if err != nil {
@@ -584,3 +994,53 @@ func TestStartNoApp(t *testing.T) {
 
 	blobstoreClient.AssertExpectations(t)
 }
+
+// Uses the in-memory stream and key-value store rather than mocks
+func TestCreateAndGetEventsInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobStore, err := blobstore.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := AppImplementation{
+		integrationClient: &integrationclient.Client{},
+		BlobStore:         blobStore,
+		Stream:            stream.NewMemory(),
+		KeyValueStore:     keyvaluestore.NewMemory(),
+	}
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := app.IsRunCreated(run.ID)
+	assert.Nil(t, err)
+	assert.True(t, created)
+	// This is what would normally get set by starting the run
+	assert.Nil(t, app.newCallbackKey(run.ID).set(""))
+	assert.Nil(t, app.newMemoryKey(run.ID).set(1073741824))
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	exitData := protocol.ExitDataStage{ExitCode: 12}
+	assert.Nil(t, app.CreateEvent(run.ID, protocol.NewFirstEvent("", run.ID, time)))
+	assert.Nil(t, app.CreateEvent(run.ID, protocol.NewFinishEvent("", run.ID, time, "build", exitData)))
+	assert.Nil(t, app.CreateEvent(run.ID, protocol.NewLastEvent("", run.ID, time)))
+
+	var types []string
+	events := app.GetEvents(run.ID, EventsOptions{LastID: "0", Follow: true})
+	for events.More() {
+		e, err := events.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{"first", "finish", "last"}, types)
+
+	e, err := app.GetExitData(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.ExitData{Build: &exitData, Finished: true}, e)
+}
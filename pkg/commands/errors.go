@@ -1,6 +1,9 @@
 package commands
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 // ErrNotFound is the error for something not being found. Use this as a sentinal value
 var ErrNotFound = errors.New("not found")
@@ -11,3 +14,46 @@ var ErrAppNotAvailable = errors.New("app not available")
 
 // ErrArchiveFormat is the error you get trying to upload an archive with a bad format
 var ErrArchiveFormat = errors.New("archive format")
+
+// ErrAlreadyExists is the error you get when something is created that is already there
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrInvalidState is the error you get when you try to do something to a run that doesn't
+// make sense at the point it's at. For instance starting a run that's already started.
+var ErrInvalidState = errors.New("invalid state")
+
+// errorList is for when we carry on after something goes wrong and report everything
+// that went wrong at the end
+type errorList []error
+
+func (list *errorList) add(err error) {
+	if err != nil {
+		*list = append(*list, err)
+	}
+}
+
+// err returns nil if nothing went wrong
+func (list errorList) err() error {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+func (list errorList) Error() string {
+	s := make([]string, len(list))
+	for i, err := range list {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Is makes errors.Is look at every error in the list
+func (list errorList) Is(target error) bool {
+	for _, err := range list {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+	"github.com/openaustralia/yinyo/pkg/stream"
+)
+
+const filenameEvents = "events.ndjson"
+
+// The number of events read from the stream at a time if not set otherwise
+const defaultEventsBatchSize = 100
+
+// How long the stream is kept around after its events have been archived. This gives anyone
+// who is part way through reading the stream a chance to finish.
+var eventsStreamExpiry = 10 * time.Minute
+
+// How long archiving the events of a run can take before it's given up on and tried again later
+var archiveEventsTimeout = 5 * time.Minute
+
+// archiveEvents copies all the events in the stream up to and including lastID to the blob
+// store as newline delimited JSON and then lets the stream expire. An empty lastID means
+// that there's nothing in the stream to archive.
+func (app *AppImplementation) archiveEvents(runID string, lastID string) error {
+	if lastID == "" {
+		return nil
+	}
+	tmpfile, err := ioutil.TempFile("", "events")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	filename := filenameEvents
+	var w io.Writer = tmpfile
+	var gzipWriter *gzip.Writer
+	if app.CompressEvents {
+		filename += ".gz"
+		gzipWriter = gzip.NewWriter(tmpfile)
+		w = gzipWriter
+	}
+	encoder := json.NewEncoder(w)
+	// The last event has already been added so this shouldn't have to wait. If it does
+	// (because lastID has been trimmed from the stream, say) don't wait forever.
+	ctx, cancel := context.WithTimeout(context.Background(), archiveEventsTimeout)
+	defer cancel()
+	for id := "0"; id != lastID; {
+		batch, err := app.Stream.Get(ctx, runID, id, app.eventsBatchSize())
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			err = encoder.Encode(e)
+			if err != nil {
+				return err
+			}
+			id = e.ID
+			if id == lastID {
+				break
+			}
+		}
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return err
+		}
+	}
+	size, err := tmpfile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = app.putBlobStoreData(tmpfile, size, runID, filename)
+	if err != nil {
+		return err
+	}
+	err = app.newEventsArchiveKey(runID).set(filename)
+	if err != nil {
+		return err
+	}
+	return app.Stream.Expire(runID, eventsStreamExpiry)
+}
+
+func (app *AppImplementation) eventsBatchSize() int64 {
+	if app.EventsBatchSize <= 0 {
+		return defaultEventsBatchSize
+	}
+	return app.EventsBatchSize
+}
+
+// openEventsArchive returns nil if the events haven't been archived. Otherwise the caller
+// needs to close the archive when they're done with it.
+func (app *AppImplementation) openEventsArchive(runID string) (*json.Decoder, io.Closer, error) {
+	var filename string
+	err := app.newEventsArchiveKey(runID).get(&filename)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err := app.getBlobStoreData(runID, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = blob
+	if strings.HasSuffix(filename, ".gz") {
+		r, err = gzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, nil, err
+		}
+	}
+	return json.NewDecoder(r), blob, nil
+}
+
+func (app *AppImplementation) deleteEventsArchive(runID string) error {
+	var filename string
+	err := app.newEventsArchiveKey(runID).get(&filename)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return app.deleteBlobStoreData(runID, filename)
+}
+
+// nextFromArchive returns the first event in the archive after the last one seen
+func (events *Events) nextFromArchive() (e protocol.Event, err error) {
+	last, err := stream.ParseID(events.options.LastID)
+	if err != nil {
+		return
+	}
+	for {
+		err = events.archive.Decode(&e)
+		// The archive always finishes with the last event so we should never get to the end
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+		var id stream.ID
+		id, err = stream.ParseID(e.ID)
+		if err != nil {
+			return
+		}
+		if id.After(last) {
+			return
+		}
+	}
+}
+
+// eventIDsAfter checks whether there are events in a stream ending with endID after lastID
+func eventIDsAfter(endID string, lastID string) (bool, error) {
+	if endID == "" {
+		return false, nil
+	}
+	end, err := stream.ParseID(endID)
+	if err != nil {
+		return false, err
+	}
+	last, err := stream.ParseID(lastID)
+	if err != nil {
+		return false, err
+	}
+	return end.After(last), nil
+}
@@ -12,6 +12,25 @@ func (app *AppImplementation) newCreatedKey(runID string) Key {
 	return app.newKey(runID, "created")
 }
 
+// Where the run is in its lifecycle
+func (app *AppImplementation) newStateKey(runID string) Key {
+	return app.newKey(runID, "state")
+}
+
+// When the run was created
+func (app *AppImplementation) newCreatedAtKey(runID string) Key {
+	return app.newKey(runID, "created_at")
+}
+
+// When something last happened to the run
+func (app *AppImplementation) newLastActivityKey(runID string) Key {
+	return app.newKey(runID, "last_activity")
+}
+
+func (app *AppImplementation) newLabelsKey(runID string) Key {
+	return app.newKey(runID, "labels")
+}
+
 func (app *AppImplementation) newCallbackKey(runID string) Key {
 	return app.newKey(runID, "url")
 }
@@ -24,6 +43,62 @@ func (app *AppImplementation) newFirstTimeKey(runID string) Key {
 	return app.newKey(runID, "first_time")
 }
 
+func (app *AppImplementation) newStageKey(runID string) Key {
+	return app.newKey(runID, "stage")
+}
+
+func (app *AppImplementation) newAPIKeyKey(runID string) Key {
+	return app.newKey(runID, "api_key")
+}
+
+// The name of the file in the blob store that the events have been archived to
+func (app *AppImplementation) newEventsArchiveKey(runID string) Key {
+	return app.newKey(runID, "events_archive")
+}
+
+func (app *AppImplementation) newQueuedKey(runID string) Key {
+	return app.newKey(runID, "queued")
+}
+
+func (app *AppImplementation) newSlotKey(runID string) Key {
+	return app.newKey(runID, "slot")
+}
+
+// The queue of runs waiting to start
+func (app *AppImplementation) newQueueKey() Key {
+	return app.newGlobalKey("queue")
+}
+
+// All the runs that haven't been deleted yet
+func (app *AppImplementation) newRunsKey() Key {
+	return app.newGlobalKey("runs")
+}
+
+// The runs whose events still need to be archived
+func (app *AppImplementation) newUnarchivedKey() Key {
+	return app.newGlobalKey("unarchived")
+}
+
+// The number of runs that have ever been created. Used to keep the runs for an API key in order.
+func (app *AppImplementation) newRunCountKey() Key {
+	return app.newGlobalKey("run_count")
+}
+
+// The runs for one API key in the order they were created
+func (app *AppImplementation) newRunsForAPIKeyKey(apiKeyID string) Key {
+	return app.newGlobalKey("runs/" + apiKeyID)
+}
+
+// The number of runs going overall
+func (app *AppImplementation) newRunningKey() Key {
+	return app.newGlobalKey("running")
+}
+
+// The number of runs going for one API key
+func (app *AppImplementation) newRunningForAPIKeyKey(apiKeyID string) Key {
+	return app.newGlobalKey("running/" + apiKeyID)
+}
+
 func (app *AppImplementation) newExitDataKey(runID string, key string) Key {
 	return app.newKey(runID, "exit_data/"+key)
 }
@@ -32,33 +107,34 @@ func (app *AppImplementation) newExitDataFinishedKey(runID string) Key {
 	return app.newExitDataKey(runID, "finished")
 }
 
+func (app *AppImplementation) newExitDataReasonKey(runID string) Key {
+	return app.newExitDataKey(runID, "reason")
+}
+
+// deleteAllKeys deletes all the keys of a run apart from the ones that say that it exists,
+// that it's being deleted and where it's indexed. It carries on if anything goes wrong.
 func (app *AppImplementation) deleteAllKeys(runID string) error {
-	// TODO: If one of these deletes fails just carry on
-	err := app.newFirstTimeKey(runID).delete()
-	if err != nil {
-		return err
-	}
-	err = app.newExitDataKey(runID, "build").delete()
-	if err != nil {
-		return err
-	}
-	err = app.newExitDataKey(runID, "execute").delete()
-	if err != nil {
-		return err
-	}
-	err = app.newExitDataFinishedKey(runID).delete()
-	if err != nil {
-		return err
-	}
-	err = app.newCallbackKey(runID).delete()
-	if err != nil {
-		return err
+	keys := []Key{
+		app.newFirstTimeKey(runID),
+		app.newStageKey(runID),
+		app.newExitDataKey(runID, "build"),
+		app.newExitDataKey(runID, "execute"),
+		app.newExitDataFinishedKey(runID),
+		app.newExitDataReasonKey(runID),
+		app.newCallbackKey(runID),
+		app.newLabelsKey(runID),
+		app.newCreatedAtKey(runID),
+		app.newLastActivityKey(runID),
+		app.newQueuedKey(runID),
+		app.newSlotKey(runID),
+		app.newEventsArchiveKey(runID),
+		app.newMemoryKey(runID),
 	}
-	err = app.newCreatedKey(runID).delete()
-	if err != nil {
-		return err
+	var errs errorList
+	for _, key := range keys {
+		errs.add(key.delete())
 	}
-	return app.newMemoryKey(runID).delete()
+	return errs.err()
 }
 
 type Key struct {
@@ -70,6 +146,11 @@ func (app *AppImplementation) newKey(runID string, key string) Key {
 	return Key{key: runID + "/" + key, client: app.KeyValueStore}
 }
 
+// newGlobalKey is for keys that aren't associated with a particular run
+func (app *AppImplementation) newGlobalKey(key string) Key {
+	return Key{key: key, client: app.KeyValueStore}
+}
+
 func (key Key) set(value interface{}) error {
 	b, err := json.Marshal(value)
 	if err != nil {
@@ -78,6 +159,28 @@ func (key Key) set(value interface{}) error {
 	return key.client.Set(key.key, string(b))
 }
 
+// setIfNotExists sets the key only if it doesn't already exist. It returns true if it was set.
+func (key Key) setIfNotExists(value interface{}) (bool, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return key.client.SetIfNotExists(key.key, string(b))
+}
+
+// compareAndSet sets the key to value only if it currently holds old. It returns true if it was set.
+func (key Key) compareAndSet(old interface{}, value interface{}) (bool, error) {
+	o, err := json.Marshal(old)
+	if err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return key.client.CompareAndSet(key.key, string(o), string(b))
+}
+
 func (key Key) get(value interface{}) error {
 	string, err := key.client.Get(key.key)
 	if err != nil {
@@ -89,6 +192,54 @@ func (key Key) get(value interface{}) error {
 	return json.Unmarshal([]byte(string), value)
 }
 
+// getAndDelete gets the value of the key and deletes it at the same time. If more than one
+// thing tries to do this at once only one of them gets the value. The others get ErrNotFound.
+func (key Key) getAndDelete(value interface{}) error {
+	string, err := key.client.GetAndDelete(key.key)
+	if err != nil {
+		if errors.Is(err, keyvaluestore.ErrKeyNotExist) {
+			return fmt.Errorf("%w", ErrNotFound)
+		}
+		return err
+	}
+	return json.Unmarshal([]byte(string), value)
+}
+
 func (key Key) delete() error {
 	return key.client.Delete(key.key)
 }
+
+func (key Key) increment(value int64) (int64, error) {
+	return key.client.Increment(key.key, value)
+}
+
+func (key Key) push(value string) error {
+	return key.client.ListPush(key.key, value)
+}
+
+func (key Key) pop() (string, error) {
+	value, err := key.client.ListPop(key.key)
+	if errors.Is(err, keyvaluestore.ErrKeyNotExist) {
+		return value, fmt.Errorf("%w", ErrNotFound)
+	}
+	return value, err
+}
+
+func (key Key) length() (int64, error) {
+	return key.client.ListLength(key.key)
+}
+
+// add puts a value in a sorted set
+func (key Key) add(value string, score int64) error {
+	return key.client.SortedSetAdd(key.key, value, score)
+}
+
+// rangeAfter returns up to count values in a sorted set with a score greater than after
+func (key Key) rangeAfter(after int64, count int64) ([]keyvaluestore.ScoredValue, error) {
+	return key.client.SortedSetRangeAfter(key.key, after, count)
+}
+
+// remove takes a value out of a sorted set
+func (key Key) remove(value string) error {
+	return key.client.SortedSetRemove(key.key, value)
+}
@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/openaustralia/yinyo/pkg/archive"
+)
+
+// presignedGetURL returns a URL where a file for the run can be downloaded directly from the
+// blob store. If presigned URLs aren't being used it returns nil.
+func (app *AppImplementation) presignedGetURL(runID string, fileName string) (*url.URL, error) {
+	if app.PresignExpiry == 0 {
+		return nil, nil
+	}
+	p := blobStoreStoragePath(runID, fileName)
+	u, err := app.BlobStore.PresignedGetURL(p, app.PresignExpiry)
+	if err != nil && app.BlobStore.IsNotExist(err) {
+		return nil, fmt.Errorf("blobstore %v: %w", p, ErrNotFound)
+	}
+	return u, err
+}
+
+// presignedPutURL returns a URL where a file for the run can be uploaded directly to the
+// blob store. If presigned URLs aren't being used it returns nil.
+func (app *AppImplementation) presignedPutURL(runID string, fileName string) (*url.URL, error) {
+	if app.PresignExpiry == 0 {
+		return nil, nil
+	}
+	return app.BlobStore.PresignedPutURL(blobStoreStoragePath(runID, fileName), app.PresignExpiry)
+}
+
+// validateArchive checks an archive that was uploaded straight to the blob store
+func (app *AppImplementation) validateArchive(reader io.Reader) error {
+	err := archive.Validate(reader)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrArchiveFormat, err)
+	}
+	return nil
+}
+
+// GetAppURL returns a URL where the app can be downloaded directly
+func (app *AppImplementation) GetAppURL(runID string) (*url.URL, error) {
+	return app.presignedGetURL(runID, filenameApp)
+}
+
+// PutAppURL returns a URL where the app can be uploaded directly. Because the server never
+// sees the app it's checked, and the run moves on to having its app uploaded, when the run
+// is started instead.
+func (app *AppImplementation) PutAppURL(runID string) (*url.URL, error) {
+	if app.PresignExpiry == 0 {
+		return nil, nil
+	}
+	err := app.checkState(runID, stateCreated, stateAppUploaded)
+	if err != nil {
+		return nil, err
+	}
+	u, err := app.presignedPutURL(runID, filenameApp)
+	if err != nil {
+		return nil, err
+	}
+	return u, app.recordActivity(runID)
+}
+
+// GetCacheURL returns a URL where the build cache can be downloaded directly. The cache could
+// have been uploaded directly too in which case nobody has checked it yet so that's done here.
+// A broken cache is treated the same as there being no cache because it's only there to make
+// the build quicker.
+func (app *AppImplementation) GetCacheURL(runID string) (*url.URL, error) {
+	if app.PresignExpiry == 0 {
+		return nil, nil
+	}
+	reader, err := app.GetCache(runID)
+	if err != nil {
+		return nil, err
+	}
+	err = app.validateArchive(reader)
+	reader.Close()
+	if errors.Is(err, ErrArchiveFormat) {
+		return nil, fmt.Errorf("cache %v: %w", err, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return app.presignedGetURL(runID, filenameCache)
+}
+
+// PutCacheURL returns a URL where the build cache can be uploaded directly. It's checked when
+// it's downloaded instead.
+func (app *AppImplementation) PutCacheURL(runID string) (*url.URL, error) {
+	return app.presignedPutURL(runID, filenameCache)
+}
+
+// GetOutputURL returns a URL where the output can be downloaded directly
+func (app *AppImplementation) GetOutputURL(runID string) (*url.URL, error) {
+	return app.presignedGetURL(runID, filenameOutput)
+}
+
+// PutOutputURL returns a URL where the output can be uploaded directly
+func (app *AppImplementation) PutOutputURL(runID string) (*url.URL, error) {
+	return app.presignedPutURL(runID, filenameOutput)
+}
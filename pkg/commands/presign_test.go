@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	blobstoremocks "github.com/openaustralia/yinyo/mocks/pkg/blobstore"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+func TestPresignNotUsed(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := app.GetAppURL(run.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+	u, err = app.PutAppURL(run.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+	// The run shouldn't have moved on because the app hasn't been uploaded
+	state, err := app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "created", state)
+}
+
+func TestPutAppURL(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	app.PresignExpiry = time.Hour
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	presigned, _ := url.Parse("https://blobs.example.com/yinyo/" + run.ID + "/app.tgz?X-Amz-Signature=abc")
+	app.BlobStore.(*blobstoremocks.BlobStore).On("PresignedPutURL", run.ID+"/app.tgz", time.Hour).Return(presigned, nil)
+
+	u, err := app.PutAppURL(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, presigned, u)
+	// Handing out the URL doesn't mean that anything has been uploaded
+	state, err := app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "created", state)
+
+	// Pretend that something that isn't an archive was uploaded. It gets caught at the start.
+	err = app.BlobStore.Put(run.ID+"/app.tgz", strings.NewReader("not an archive"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.StartRun(run.ID, "image", protocol.StartRunOptions{})
+	assert.True(t, errors.Is(err, ErrArchiveFormat))
+	state, err = app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "created", state)
+
+	// Now upload a proper app
+	file, err := os.Open("testdata/empty.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = app.BlobStore.Put(run.ID+"/app.tgz", file, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, app.StartRun(run.ID, "image", protocol.StartRunOptions{}))
+	state, err = app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "started", state)
+
+	// And the app can't be changed anymore
+	_, err = app.PutAppURL(run.ID)
+	assert.True(t, errors.Is(err, ErrInvalidState))
+}
+
+func TestGetCacheURLNotFound(t *testing.T) {
+	blobStore := new(blobstoremocks.BlobStore)
+	app := AppImplementation{BlobStore: blobStore, PresignExpiry: time.Hour}
+	notExist := errors.New("NoSuchKey")
+	blobStore.On("Get", "run-name/cache.tgz").Return(nil, notExist)
+	blobStore.On("IsNotExist", notExist).Return(true)
+
+	_, err := app.GetCacheURL("run-name")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	blobStore.AssertExpectations(t)
+}
+
+func TestGetCacheURL(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	app.PresignExpiry = time.Hour
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	presigned, _ := url.Parse("https://blobs.example.com/yinyo/" + run.ID + "/cache.tgz?X-Amz-Signature=abc")
+	app.BlobStore.(*blobstoremocks.BlobStore).On("PresignedGetURL", run.ID+"/cache.tgz", time.Hour).Return(presigned, nil)
+
+	// Something that isn't an archive was uploaded straight to the blob store. It's as if
+	// there's no cache at all.
+	err = app.BlobStore.Put(run.ID+"/cache.tgz", strings.NewReader("not an archive"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.GetCacheURL(run.ID)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// Now upload a proper cache
+	file, err := os.Open("testdata/empty.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = app.BlobStore.Put(run.ID+"/cache.tgz", file, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := app.GetCacheURL(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, presigned, u)
+}
@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+// queuedRun is everything needed to start a run once it gets to the front of the queue
+type queuedRun struct {
+	DockerImage string                   `json:"docker_image"`
+	Options     protocol.StartRunOptions `json:"options"`
+}
+
+// apiKeyID identifies an API key without giving away the key itself
+func apiKeyID(apiKey string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(apiKey)))
+}
+
+// queueing returns true if there are any limits on how many runs can go at the same time
+func (app *AppImplementation) queueing() bool {
+	return app.MaxRuns > 0 || app.MaxRunsPerAPIKey > 0
+}
+
+// takeSlot increments the count of running runs unless that would go over max. A max of 0 means no limit
+func takeSlot(key Key, max int64) (bool, error) {
+	running, err := key.increment(1)
+	if err != nil {
+		return false, err
+	}
+	if max > 0 && running > max {
+		_, err = key.increment(-1)
+		return false, err
+	}
+	return true, nil
+}
+
+// acquireSlot returns true if the run can start now without going over any of the limits.
+// If so the run holds a slot until finishedWithSlot is called.
+func (app *AppImplementation) acquireSlot(runID string) (bool, error) {
+	var apiKeyID string
+	err := app.newAPIKeyKey(runID).get(&apiKeyID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	ok, err := takeSlot(app.newRunningKey(), app.MaxRuns)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = takeSlot(app.newRunningForAPIKeyKey(apiKeyID), app.MaxRunsPerAPIKey)
+	if err != nil || !ok {
+		// Give back the overall slot we just took
+		if _, err2 := app.newRunningKey().increment(-1); err2 != nil {
+			return false, err2
+		}
+		return false, err
+	}
+	return true, app.newSlotKey(runID).set(true)
+}
+
+// releaseSlot gives back the slot held by a run. It returns true if a slot was given back.
+// It's safe to call this more than once for the same run.
+func (app *AppImplementation) releaseSlot(runID string) (bool, error) {
+	// Only the first caller gets to give back the slot
+	released, err := app.newSlotKey(runID).compareAndSet(true, false)
+	if err != nil || !released {
+		return false, err
+	}
+	var apiKeyID string
+	err = app.newAPIKeyKey(runID).get(&apiKeyID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	_, err = app.newRunningKey().increment(-1)
+	if err != nil {
+		return false, err
+	}
+	_, err = app.newRunningForAPIKeyKey(apiKeyID).increment(-1)
+	return true, err
+}
+
+// finishedWithSlot is called when a run is done. It gives back the slot held by the run
+// and starts whatever runs in the queue can now go.
+func (app *AppImplementation) finishedWithSlot(runID string) error {
+	released, err := app.releaseSlot(runID)
+	if err != nil || !released {
+		return err
+	}
+	// A problem starting other runs shouldn't be reported as a problem with this one
+	err = app.dispatchQueued()
+	if err != nil {
+		log.Printf("Couldn't start queued runs: %v", err)
+	}
+	return nil
+}
+
+// queueRun puts the run at the back of the queue to be started later by dispatchQueued
+func (app *AppImplementation) queueRun(runID string, dockerImage string, options protocol.StartRunOptions) error {
+	err := app.newQueuedKey(runID).set(queuedRun{DockerImage: dockerImage, Options: options})
+	if err != nil {
+		return err
+	}
+	err = app.newQueueKey().push(runID)
+	if err != nil {
+		// Otherwise the run would look like it's waiting in a queue that it isn't in
+		err2 := app.newQueuedKey(runID).delete()
+		if err2 != nil {
+			log.Printf("Run %v: couldn't forget that it was queued: %v", runID, err2)
+		}
+		return err
+	}
+	// The run is in the queue now and will be started whatever happens here. So, not being
+	// able to tell anyone about it shouldn't make starting the run fail.
+	err = app.CreateEvent(runID, protocol.NewQueuedEvent("", runID, time.Now()))
+	if err != nil {
+		log.Printf("Run %v: couldn't send queued event: %v", runID, err)
+	}
+	return nil
+}
+
+// requeueRun puts a run that was taken off the queue back on the end of it
+func (app *AppImplementation) requeueRun(runID string, queued queuedRun) error {
+	err := app.newQueuedKey(runID).set(queued)
+	if err != nil {
+		return err
+	}
+	return app.newQueueKey().push(runID)
+}
+
+func (app *AppImplementation) isQueued(runID string) (bool, error) {
+	var queued queuedRun
+	err := app.newQueuedKey(runID).get(&queued)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// startDispatcher looks at the queue in the background every interval. Normally queued runs
+// are started when another run finishes but this catches any that were missed, for instance
+// because the server was restarted or starting a run didn't work.
+func (app *AppImplementation) startDispatcher() {
+	if app.DispatchInterval == 0 || !app.queueing() {
+		return
+	}
+	ticker := time.NewTicker(app.DispatchInterval)
+	go func() {
+		for range ticker.C {
+			err := app.dispatchQueued()
+			if err != nil {
+				log.Printf("Couldn't start queued runs: %v", err)
+			}
+		}
+	}()
+}
+
+// dispatchQueued starts as many of the queued runs as the limits allow. Runs are started in
+// the order they were queued except that runs for an API key that is at its limit don't hold
+// up the runs for other API keys behind them.
+func (app *AppImplementation) dispatchQueued() error {
+	// Go through the queue at most once
+	n, err := app.newQueueKey().length()
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < n; i++ {
+		runID, err := app.newQueueKey().pop()
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Claim the run so that it can't be started twice or cancelled part way through
+		// being started
+		var queued queuedRun
+		err = app.newQueuedKey(runID).getAndDelete(&queued)
+		if errors.Is(err, ErrNotFound) {
+			// The run was cancelled or deleted while it was waiting
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		admitted, err := app.acquireSlot(runID)
+		if err != nil || !admitted {
+			// Put it back at the end of the queue to try again later
+			err2 := app.requeueRun(runID, queued)
+			if err2 != nil {
+				return err2
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// If the run was cancelled after it was claimed above don't start it after all
+		state, err := app.getState(runID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if state != stateStarted {
+			_, err = app.releaseSlot(runID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = app.createJob(runID, queued.DockerImage, queued.Options)
+		if err != nil {
+			log.Printf("Run %v: couldn't start after waiting in the queue: %v", runID, err)
+			// Finishing the run also gives back its slot
+			err = app.finishRun(runID, "failed")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	blobstoremocks "github.com/openaustralia/yinyo/mocks/pkg/blobstore"
+	jobdispatchermocks "github.com/openaustralia/yinyo/mocks/pkg/jobdispatcher"
+	"github.com/openaustralia/yinyo/pkg/integrationclient"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
+	"github.com/openaustralia/yinyo/pkg/keyvaluestore"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+	"github.com/openaustralia/yinyo/pkg/stream"
+)
+
+func newQueueingApp(maxRuns int64, maxRunsPerAPIKey int64) (*AppImplementation, *jobdispatchermocks.Jobs) {
+	job := new(jobdispatchermocks.Jobs)
+	blobStore := new(blobstoremocks.BlobStore)
+	// Keep whatever is put in the blob store so that the app and archived events can be read back
+	blobs := make(map[string][]byte)
+	blobStore.On("Put", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		b, _ := ioutil.ReadAll(args.Get(1).(io.Reader))
+		blobs[args.String(0)] = b
+	}).Return(nil)
+	blobStore.On("Get", mock.Anything).Return(func(path string) io.ReadCloser {
+		return ioutil.NopCloser(bytes.NewReader(blobs[path]))
+	}, nil)
+	blobStore.On("Delete", mock.Anything).Return(nil)
+	job.On("CheckScheduling", mock.Anything).Return(nil)
+	job.On("Create", mock.Anything, mock.Anything).Return(nil)
+	job.On("Delete", mock.Anything).Return(nil)
+
+	return &AppImplementation{
+		integrationClient: &integrationclient.Client{},
+		BlobStore:         blobStore,
+		JobDispatcher:     job,
+		Stream:            stream.NewMemory(),
+		KeyValueStore:     keyvaluestore.NewMemory(),
+		MaxRuns:           maxRuns,
+		MaxRunsPerAPIKey:  maxRunsPerAPIKey,
+	}, job
+}
+
+func createAndStartRun(t *testing.T, app *AppImplementation, apiKey string) string {
+	run, err := app.CreateRun(protocol.CreateRunOptions{APIKey: apiKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putEmptyApp(app, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.StartRun(run.ID, "image", protocol.StartRunOptions{Memory: 1073741824})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return run.ID
+}
+
+func assertState(t *testing.T, app *AppImplementation, runID string, state string) {
+	status, err := app.GetStatus(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, state, status.State)
+}
+
+func TestQueuePerAPIKey(t *testing.T) {
+	app, job := newQueueingApp(0, 1)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	run2 := createAndStartRun(t, app, "key-a")
+	// There's no job until the run gets out of the queue
+	job.On("GetStatus", run2).Return(jobdispatcher.Status{}, jobdispatcher.ErrNotFound).Once()
+	job.On("GetStatus", run2).Return(jobdispatcher.Status{State: jobdispatcher.StatePending}, nil)
+	// A different API key has its own limit
+	run3 := createAndStartRun(t, app, "key-b")
+
+	job.AssertCalled(t, "Create", run1, mock.Anything)
+	job.AssertNotCalled(t, "Create", run2, mock.Anything)
+	job.AssertCalled(t, "Create", run3, mock.Anything)
+	assertState(t, app, run2, "queued")
+	events, err := app.Stream.Get(context.Background(), run2, "0", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "queued", events[0].Type)
+
+	// When the first run finishes the second one can go
+	err = app.CreateEvent(run1, protocol.NewLastEvent("", run1, time.Now()))
+	assert.Nil(t, err)
+	job.AssertCalled(t, "Create", run2, mock.Anything)
+	assertState(t, app, run2, "pending")
+
+	// Sending the last event again isn't allowed and doesn't give back another slot
+	err = app.CreateEvent(run1, protocol.NewLastEvent("", run1, time.Now()))
+	assert.True(t, errors.Is(err, ErrInvalidState))
+	run4 := createAndStartRun(t, app, "key-a")
+	job.AssertNotCalled(t, "Create", run4, mock.Anything)
+}
+
+func TestQueueOverall(t *testing.T) {
+	app, job := newQueueingApp(2, 0)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	run2 := createAndStartRun(t, app, "key-b")
+	run3 := createAndStartRun(t, app, "key-c")
+	run4 := createAndStartRun(t, app, "key-d")
+
+	job.AssertCalled(t, "Create", run1, mock.Anything)
+	job.AssertCalled(t, "Create", run2, mock.Anything)
+	job.AssertNotCalled(t, "Create", run3, mock.Anything)
+	job.AssertNotCalled(t, "Create", run4, mock.Anything)
+
+	// Runs are started in the order they were queued
+	err := app.DeleteRun(run2)
+	assert.Nil(t, err)
+	job.AssertCalled(t, "Create", run3, mock.Anything)
+	job.AssertNotCalled(t, "Create", run4, mock.Anything)
+}
+
+func TestQueueCreateJobFails(t *testing.T) {
+	app, job := newQueueingApp(1, 0)
+	job.ExpectedCalls = nil
+	job.On("CheckScheduling", mock.Anything).Return(nil)
+	job.On("Create", mock.Anything, mock.Anything).Return(errors.New("Something went wrong")).Once()
+	job.On("Create", mock.Anything, mock.Anything).Return(nil)
+
+	run1, err := app.CreateRun(protocol.CreateRunOptions{APIKey: "key-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, putEmptyApp(app, run1.ID))
+	err = app.StartRun(run1.ID, "image", protocol.StartRunOptions{})
+	assert.EqualError(t, err, "Something went wrong")
+
+	// The slot that the first run had is given back so this one can go straight away
+	run2 := createAndStartRun(t, app, "key-a")
+	job.AssertCalled(t, "Create", run2, mock.Anything)
+}
+
+func TestQueueDispatcher(t *testing.T) {
+	app, job := newQueueingApp(1, 0)
+	job.ExpectedCalls = nil
+	job.On("CheckScheduling", mock.Anything).Return(nil)
+	created := make(chan string, 2)
+	job.On("Create", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		created <- args.String(0)
+	}).Return(nil)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	assert.Equal(t, run1, <-created)
+	run2 := createAndStartRun(t, app, "key-a")
+
+	// Give back the slot without starting anything from the queue like if the server went
+	// away at just the wrong moment. The queued run still gets started eventually.
+	released, err := app.releaseSlot(run1)
+	assert.Nil(t, err)
+	assert.True(t, released)
+	app.DispatchInterval = 10 * time.Millisecond
+	app.startDispatcher()
+	select {
+	case runID := <-created:
+		assert.Equal(t, run2, runID)
+	case <-time.After(time.Second):
+		t.Error("queued run wasn't started")
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	app, job := newQueueingApp(1, 0)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	run2 := createAndStartRun(t, app, "key-a")
+	run3 := createAndStartRun(t, app, "key-a")
+
+	// Cancelling a run that is waiting means it never gets started
+	err := app.CancelRun(run2)
+	assert.Nil(t, err)
+	var types []string
+	for _, e := range getAllEvents(t, app, run2) {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{"queued", "last"}, types)
+
+	err = app.CancelRun(run1)
+	assert.Nil(t, err)
+	job.AssertNotCalled(t, "Create", run2, mock.Anything)
+	job.AssertCalled(t, "Create", run3, mock.Anything)
+}
+
+// brokenStream can't have anything added to it
+type brokenStream struct {
+	stream.Stream
+}
+
+func (s brokenStream) Add(key string, event protocol.Event) (protocol.Event, error) {
+	return event, errors.New("stream down")
+}
+
+func TestQueueEventFails(t *testing.T) {
+	app, job := newQueueingApp(1, 0)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	run2, err := app.CreateRun(protocol.CreateRunOptions{APIKey: "key-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, putEmptyApp(app, run2.ID))
+	// The queued event can't be sent but the run is queued anyway
+	working := app.Stream
+	app.Stream = brokenStream{working}
+	err = app.StartRun(run2.ID, "image", protocol.StartRunOptions{})
+	app.Stream = working
+	assert.Nil(t, err)
+	queued, err := app.isQueued(run2.ID)
+	assert.Nil(t, err)
+	assert.True(t, queued)
+	state, err := app.getState(run2.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "started", state)
+
+	assert.Nil(t, app.CancelRun(run1))
+	job.AssertCalled(t, "Create", run2.ID, mock.Anything)
+}
+
+func TestQueueCancelledWhileBeingDispatched(t *testing.T) {
+	app, job := newQueueingApp(1, 0)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	run2 := createAndStartRun(t, app, "key-a")
+	// The run finishes (by being cancelled, say) just after the dispatcher takes it off the queue
+	assert.Nil(t, app.newStateKey(run2).set(stateFinished))
+
+	assert.Nil(t, app.CancelRun(run1))
+	job.AssertNotCalled(t, "Create", run2, mock.Anything)
+	// The slot the dispatcher took for it was given back
+	run3 := createAndStartRun(t, app, "key-a")
+	job.AssertCalled(t, "Create", run3, mock.Anything)
+}
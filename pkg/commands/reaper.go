@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// ReaperOptions say when runs that have been left lying around are deleted. Each TTL is how
+// long after anything last happened to a run it gets deleted. A TTL of 0 means that runs in
+// that state are never deleted.
+type ReaperOptions struct {
+	// How often to look for runs to delete. 0 means the reaper doesn't go at all
+	Interval time.Duration
+	// For runs that were created but never started
+	NotStartedTTL time.Duration
+	// For runs that have finished but were never deleted
+	FinishedTTL time.Duration
+	// For runs that were started but haven't finished
+	RunningTTL time.Duration
+}
+
+// recordActivity remembers when something last happened to a run so that the reaper
+// knows when it's been abandoned
+func (app *AppImplementation) recordActivity(runID string) error {
+	return app.newLastActivityKey(runID).set(time.Now())
+}
+
+// startReaper deletes abandoned runs in the background every interval
+func (app *AppImplementation) startReaper() {
+	if app.Reaper.Interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(app.Reaper.Interval)
+	go func() {
+		for now := range ticker.C {
+			err := app.reap(now)
+			if err != nil {
+				log.Printf("Couldn't delete abandoned runs: %v", err)
+			}
+		}
+	}()
+}
+
+// ttl returns how long a run in a particular state can go without anything happening before
+// it gets deleted. 0 means forever.
+func (app *AppImplementation) ttl(state string) time.Duration {
+	switch state {
+	case stateCreated, stateAppUploaded:
+		return app.Reaper.NotStartedTTL
+	case stateStarted:
+		return app.Reaper.RunningTTL
+	case stateFinished:
+		return app.Reaper.FinishedTTL
+	}
+	return 0
+}
+
+// abandoned returns true if nothing has happened to the run for longer than its TTL
+func (app *AppImplementation) abandoned(runID string, now time.Time) (bool, error) {
+	state, err := app.getState(runID)
+	// Runs that weren't completely deleted are left for retryDeleting
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	ttl := app.ttl(state)
+	if ttl == 0 {
+		return false, nil
+	}
+	var lastActivity time.Time
+	err = app.newLastActivityKey(runID).get(&lastActivity)
+	if err != nil {
+		return false, err
+	}
+	return now.Sub(lastActivity) > ttl, nil
+}
+
+// reap goes once through all the runs and deletes the ones that have been abandoned
+func (app *AppImplementation) reap(now time.Time) error {
+	return app.sweepRuns("it has been abandoned", func(runID string) (bool, error) {
+		return app.abandoned(runID, now)
+	})
+}
+
+// sweepRuns goes once through all the runs and deletes the ones that shouldDelete says to. Like
+// the queue each run is taken off the front of the list and put back on the end if it's kept
+// so that more than one server can do this at the same time.
+func (app *AppImplementation) sweepRuns(why string, shouldDelete func(runID string) (bool, error)) error {
+	n, err := app.newRunsKey().length()
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < n; i++ {
+		runID, err := app.newRunsKey().pop()
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		created, err := app.IsRunCreated(runID)
+		if err != nil {
+			return err
+		}
+		// If the run has already been deleted we can forget about it
+		if !created {
+			continue
+		}
+		del, err := shouldDelete(runID)
+		if err != nil {
+			log.Printf("Run %v: couldn't check whether to delete it: %v", runID, err)
+		} else if del {
+			log.Printf("Run %v: deleting because %v", runID, why)
+			err = app.DeleteRun(runID)
+			if err == nil {
+				continue
+			}
+			log.Printf("Run %v: couldn't delete: %v", runID, err)
+		}
+		// Look at it again next time
+		err = app.newRunsKey().push(runID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+func TestReap(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	app.Reaper = ReaperOptions{NotStartedTTL: time.Hour, FinishedTTL: 2 * time.Hour}
+
+	notStarted, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := createAndStartRun(t, app, "")
+	finished := createAndStartRun(t, app, "")
+	assert.Nil(t, app.CreateEvent(finished, protocol.NewLastEvent("", finished, time.Now())))
+
+	// Nothing has been around long enough yet
+	assert.Nil(t, app.reap(time.Now()))
+	for _, runID := range []string{notStarted.ID, running, finished} {
+		created, err := app.IsRunCreated(runID)
+		assert.Nil(t, err)
+		assert.True(t, created)
+	}
+
+	// Only the run that was never started has been abandoned
+	assert.Nil(t, app.reap(time.Now().Add(90*time.Minute)))
+	created, err := app.IsRunCreated(notStarted.ID)
+	assert.Nil(t, err)
+	assert.False(t, created)
+	created, err = app.IsRunCreated(finished)
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	// Runs that are still going are kept forever because there's no TTL for them
+	assert.Nil(t, app.reap(time.Now().Add(24*time.Hour)))
+	created, err = app.IsRunCreated(finished)
+	assert.Nil(t, err)
+	assert.False(t, created)
+	created, err = app.IsRunCreated(running)
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	// And it's still there to be looked at next time
+	n, err := app.newRunsKey().length()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// startRetrier has another go in the background every interval at the things that didn't
+// work the first time and can safely be done later
+func (app *AppImplementation) startRetrier() {
+	if app.RetryInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(app.RetryInterval)
+	go func() {
+		for range ticker.C {
+			err := app.retryArchiving()
+			if err != nil {
+				log.Printf("Couldn't archive events: %v", err)
+			}
+			err = app.retryDeleting()
+			if err != nil {
+				log.Printf("Couldn't delete runs: %v", err)
+			}
+		}
+	}()
+}
+
+// archiveEventsInBackground archives the events of a run that has just finished. If that
+// doesn't work it's tried again later rather than failing the last event (which can't be sent again).
+func (app *AppImplementation) archiveEventsInBackground(runID string, lastID string) {
+	err := app.archiveEvents(runID, lastID)
+	if err == nil {
+		return
+	}
+	log.Printf("Run %v: couldn't archive events: %v", runID, err)
+	err = app.newUnarchivedKey().push(runID)
+	if err != nil {
+		log.Printf("Run %v: couldn't remember to archive events later: %v", runID, err)
+	}
+}
+
+// retryArchiving goes once through the runs whose events couldn't be archived when they
+// finished and tries again. Like the queue each run is taken off the front of the list and
+// put back on the end if it still didn't work so that more than one server can do this at
+// the same time.
+func (app *AppImplementation) retryArchiving() error {
+	n, err := app.newUnarchivedKey().length()
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < n; i++ {
+		runID, err := app.newUnarchivedKey().pop()
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// If the run has been deleted in the meantime there's nothing left to archive
+		created, err := app.IsRunCreated(runID)
+		if err != nil {
+			return err
+		}
+		if !created {
+			continue
+		}
+		lastID, err := app.Stream.LastID(runID)
+		if err == nil {
+			err = app.archiveEvents(runID, lastID)
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("Run %v: couldn't archive events: %v", runID, err)
+		// Try again next time
+		err = app.newUnarchivedKey().push(runID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryDeleting goes once through all the runs and has another go at deleting the ones that
+// weren't completely deleted before
+func (app *AppImplementation) retryDeleting() error {
+	return app.sweepRuns("it wasn't completely deleted", app.partlyDeleted)
+}
+
+// partlyDeleted returns true if deleting the run was started but didn't finish
+func (app *AppImplementation) partlyDeleted(runID string) (bool, error) {
+	state, err := app.getState(runID)
+	// The state is one of the last things to go when a run is deleted. So, if it's missing
+	// deleting the run got most of the way and it needs finishing off.
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	return state == stateDeleting, err
+}
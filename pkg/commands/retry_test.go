@@ -0,0 +1,103 @@
+package commands
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	blobstoremocks "github.com/openaustralia/yinyo/mocks/pkg/blobstore"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+func TestArchiveEventsRetried(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	runID := createAndStartRun(t, app, "")
+
+	// The blob store isn't working when the run finishes
+	blobStore := app.BlobStore.(*blobstoremocks.BlobStore)
+	calls := blobStore.ExpectedCalls
+	blobStore.ExpectedCalls = nil
+	blobStore.On("Put", runID+"/events.ndjson", mock.Anything, mock.Anything).Return(errors.New("blob store down")).Once()
+	blobStore.ExpectedCalls = append(blobStore.ExpectedCalls, calls...)
+
+	finished := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, finished)))
+	// Not being able to archive the events doesn't stop the run from finishing
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLastEvent("", runID, finished)))
+	state, err := app.getState(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, "finished", state)
+	streamed := getAllEvents(t, app, runID)
+	assert.Len(t, streamed, 2)
+	// Archiving in the background fails and the run is left to be tried again later
+	assert.Eventually(t, func() bool {
+		n, err := app.newUnarchivedKey().length()
+		return err == nil && n == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	var filename string
+	assert.True(t, errors.Is(app.newEventsArchiveKey(runID).get(&filename), ErrNotFound))
+
+	// Next time around it works
+	assert.Nil(t, app.retryArchiving())
+	assert.Nil(t, app.newEventsArchiveKey(runID).get(&filename))
+	assert.Equal(t, "events.ndjson", filename)
+	n, err := app.newUnarchivedKey().length()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// Take the stream away so that the only place to get the events from is the archive
+	assert.Nil(t, app.Stream.Delete(runID))
+	assert.Equal(t, streamed, getAllEvents(t, app, runID))
+}
+
+func TestRetryArchivingDeletedRun(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	assert.Nil(t, app.newUnarchivedKey().push("deleted-run"))
+
+	assert.Nil(t, app.retryArchiving())
+	n, err := app.newUnarchivedKey().length()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestRetryArchivingEmptyStream(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There's nothing in the stream, perhaps because it expired, so there's nothing to wait for
+	assert.Nil(t, app.newUnarchivedKey().push(run.ID))
+
+	assert.Nil(t, app.retryArchiving())
+	n, err := app.newUnarchivedKey().length()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestRetryDeletingRunWithoutState(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleting the run stopped just before the end
+	assert.Nil(t, app.newStateKey(run.ID).delete())
+
+	// The reaper leaves it alone
+	assert.Nil(t, app.reap(time.Now().Add(time.Hour)))
+	created, err := app.IsRunCreated(run.ID)
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	assert.Nil(t, app.retryDeleting())
+	created, err = app.IsRunCreated(run.ID)
+	assert.Nil(t, err)
+	assert.False(t, created)
+	n, err := app.newRunsKey().length()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+// The number of run IDs read from the index at a time when listing runs
+const listRunsBatchSize = 100
+
+// ListRunsOptions control which runs ListRuns returns
+type ListRunsOptions struct {
+	// Only runs created with this API key are listed. If it's empty the runs created
+	// without an API key are listed.
+	APIKey string
+	// Only include runs in these phases. Empty means all of them
+	Phases []string
+	// Where to carry on from. This is the cursor of the previous page. Start with 0.
+	After int64
+	// If Limit isn't 0 no more than this number of runs are returned
+	Limit int
+}
+
+// runsIndexID is what the runs for an API key are indexed under. Runs without an API key
+// are indexed under "".
+func runsIndexID(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	return apiKeyID(apiKey)
+}
+
+// indexRun adds a newly created run to the index of runs for its API key. The runs are
+// numbered in the order they were created so that where we are in the index isn't affected
+// by other runs being deleted.
+func (app *AppImplementation) indexRun(runID string, apiKey string) error {
+	err := app.newCreatedAtKey(runID).set(time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := app.newRunCountKey().increment(1)
+	if err != nil {
+		return err
+	}
+	return app.newRunsForAPIKeyKey(runsIndexID(apiKey)).add(runID, n)
+}
+
+// unindexRun removes a run from the index when it has been deleted
+func (app *AppImplementation) unindexRun(runID string) error {
+	var indexID string
+	err := app.newAPIKeyKey(runID).get(&indexID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return app.newRunsForAPIKeyKey(indexID).remove(runID)
+}
+
+// ListRuns returns the runs for an API key in the order they were created
+func (app *AppImplementation) ListRuns(options ListRunsOptions) (protocol.RunsPage, error) {
+	page := protocol.RunsPage{Runs: []protocol.RunSummary{}}
+	// Otherwise anyone who knew (or guessed) an API key could see its runs
+	err := app.integrationClient.AuthenticateAPIKey(options.APIKey)
+	if err != nil {
+		return page, err
+	}
+	key := app.newRunsForAPIKeyKey(runsIndexID(options.APIKey))
+	after := options.After
+	for options.Limit == 0 || len(page.Runs) < options.Limit {
+		runs, err := key.rangeAfter(after, listRunsBatchSize)
+		if err != nil {
+			return page, err
+		}
+		if len(runs) == 0 {
+			break
+		}
+		for _, run := range runs {
+			after = run.Score
+			summary, err := app.runSummary(run.Value)
+			if err != nil {
+				return page, err
+			}
+			if len(options.Phases) == 0 || contains(options.Phases, summary.Phase) {
+				page.Runs = append(page.Runs, summary)
+			}
+			if options.Limit != 0 && len(page.Runs) == options.Limit {
+				break
+			}
+		}
+	}
+	// Check whether there's anything after where we got to
+	rest, err := key.rangeAfter(after, 1)
+	if err != nil {
+		return page, err
+	}
+	page.Cursor = strconv.FormatInt(after, 10)
+	page.More = len(rest) > 0
+	return page, nil
+}
+
+func (app *AppImplementation) runSummary(runID string) (protocol.RunSummary, error) {
+	summary := protocol.RunSummary{ID: runID}
+	// If the run is part way through being deleted some of this might already be gone
+	err := app.newCreatedAtKey(runID).get(&summary.CreatedAt)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return summary, err
+	}
+	summary.Phase, err = app.getState(runID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return summary, err
+	}
+	summary.Labels, err = app.getLabels(runID)
+	if err != nil {
+		return summary, err
+	}
+	summary.ExitData, err = app.GetExitData(runID)
+	return summary, err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
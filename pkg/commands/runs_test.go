@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/openaustralia/yinyo/pkg/integrationclient"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+func runIDs(page protocol.RunsPage) []string {
+	var ids []string
+	for _, r := range page.Runs {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestListRuns(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+
+	run1 := createAndStartRun(t, app, "key-a")
+	run2, err := app.CreateRun(protocol.CreateRunOptions{APIKey: "key-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run3 := createAndStartRun(t, app, "key-a")
+	assert.Nil(t, app.CreateEvent(run3, protocol.NewLastEvent("", run3, time.Now())))
+	// A run for someone else
+	createAndStartRun(t, app, "key-b")
+
+	page, err := app.ListRuns(ListRunsOptions{APIKey: "key-a"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{run1, run2.ID, run3}, runIDs(page))
+	assert.Equal(t, "started", page.Runs[0].Phase)
+	assert.Equal(t, "created", page.Runs[1].Phase)
+	assert.Equal(t, "finished", page.Runs[2].Phase)
+	assert.True(t, page.Runs[2].ExitData.Finished)
+	assert.False(t, page.Runs[0].CreatedAt.IsZero())
+	assert.False(t, page.More)
+
+	// Two at a time
+	page, err = app.ListRuns(ListRunsOptions{APIKey: "key-a", Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{run1, run2.ID}, runIDs(page))
+	assert.True(t, page.More)
+	cursor, err := strconv.ParseInt(page.Cursor, 10, 64)
+	assert.Nil(t, err)
+	// Deleting a run on the page we've already seen doesn't change where the next page starts
+	assert.Nil(t, app.DeleteRun(run2.ID))
+	page, err = app.ListRuns(ListRunsOptions{APIKey: "key-a", Limit: 2, After: cursor})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{run3}, runIDs(page))
+	assert.False(t, page.More)
+
+	// Only the ones that are going
+	page, err = app.ListRuns(ListRunsOptions{APIKey: "key-a", Phases: []string{"started"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{run1}, runIDs(page))
+
+	// Deleted runs aren't listed
+	assert.Nil(t, app.DeleteRun(run1))
+	page, err = app.ListRuns(ListRunsOptions{APIKey: "key-a"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{run3}, runIDs(page))
+}
+
+func TestListRunsWithLabels(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+
+	labels := map[string]string{"scraper": "planningalerts", "example.com/sha": "abc123"}
+	run, err := app.CreateRun(protocol.CreateRunOptions{Labels: labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := app.ListRuns(ListRunsOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, run.ID, page.Runs[0].ID)
+	assert.Equal(t, labels, page.Runs[0].Labels)
+	assert.Nil(t, page.Runs[1].Labels)
+}
+
+func TestCreateRunInvalidLabels(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+
+	_, err := app.CreateRun(protocol.CreateRunOptions{Labels: map[string]string{"scraper": "not a valid value"}})
+	assert.True(t, errors.Is(err, jobdispatcher.ErrInvalidLabels))
+	// The run shouldn't have been created
+	page, err := app.ListRuns(ListRunsOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, page.Runs)
+}
+
+func TestListRunsWithAuthentication(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	roundTripper := new(MockRoundTripper)
+	app.integrationClient = integrationclient.New(&http.Client{Transport: roundTripper}, "http://foo.com/authenticate", "", "")
+	roundTripper.On("RoundTrip", mock.MatchedBy(func(r *http.Request) bool {
+		return r.URL.Query().Get("api_key") == "key-a"
+	})).Return(
+		&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"allowed":true}`)),
+		},
+		nil,
+	)
+	roundTripper.On("RoundTrip", mock.MatchedBy(func(r *http.Request) bool {
+		return r.URL.Query().Get("api_key") == "key-b"
+	})).Return(
+		&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"allowed":false,"message":"Unknown key"}`)),
+		},
+		nil,
+	)
+
+	page, err := app.ListRuns(ListRunsOptions{APIKey: "key-a"})
+	assert.Nil(t, err)
+	assert.Empty(t, page.Runs)
+	_, err = app.ListRuns(ListRunsOptions{APIKey: "key-b"})
+	assert.True(t, errors.Is(err, integrationclient.ErrNotAllowed))
+	// Without a key there's no point even asking
+	_, err = app.ListRuns(ListRunsOptions{})
+	assert.True(t, errors.Is(err, integrationclient.ErrNotAllowed))
+	roundTripper.AssertNumberOfCalls(t, "RoundTrip", 2)
+}
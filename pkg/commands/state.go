@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"fmt"
+)
+
+// The states that a run goes through. A run can only move forward through these.
+const (
+	stateCreated     = "created"
+	stateAppUploaded = "app_uploaded"
+	stateStarted     = "started"
+	stateFinished    = "finished"
+	// A run stays in this state until everything to do with it has been deleted
+	stateDeleting = "deleting"
+)
+
+func (app *AppImplementation) getState(runID string) (string, error) {
+	var state string
+	err := app.newStateKey(runID).get(&state)
+	return state, err
+}
+
+// checkState returns ErrInvalidState if the run isn't currently in one of the allowed states
+func (app *AppImplementation) checkState(runID string, allowed ...string) error {
+	state, err := app.getState(runID)
+	if err != nil {
+		return err
+	}
+	for _, a := range allowed {
+		if state == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("run is %v: %w", state, ErrInvalidState)
+}
+
+// transition atomically moves the run to a new state but only if it's currently in one of
+// the from states. Otherwise it returns ErrInvalidState.
+func (app *AppImplementation) transition(runID string, to string, from ...string) error {
+	for {
+		state, err := app.getState(runID)
+		if err != nil {
+			return err
+		}
+		allowed := false
+		for _, f := range from {
+			if state == f {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("run is %v and can't become %v: %w", state, to, ErrInvalidState)
+		}
+		ok, err := app.newStateKey(runID).compareAndSet(state, to)
+		if err != nil || ok {
+			return err
+		}
+		// The state was changed by someone else since we looked at it so look again
+	}
+}
@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+func putEmptyApp(app *AppImplementation, runID string) error {
+	file, err := os.Open("testdata/empty.tgz")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return app.PutApp(runID, file, stat.Size())
+}
+
+func TestStateTransitions(t *testing.T) {
+	app, _ := newQueueingApp(0, 0)
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The app can be uploaded more than once before the run is started
+	assert.Nil(t, putEmptyApp(app, run.ID))
+	assert.Nil(t, putEmptyApp(app, run.ID))
+	assert.Nil(t, app.StartRun(run.ID, "image", protocol.StartRunOptions{}))
+
+	// But a run can't be started twice or have its app changed once started
+	err = app.StartRun(run.ID, "image", protocol.StartRunOptions{})
+	assert.True(t, errors.Is(err, ErrInvalidState))
+	err = putEmptyApp(app, run.ID)
+	assert.True(t, errors.Is(err, ErrInvalidState))
+
+	// Nothing can come after the last event
+	assert.Nil(t, app.CreateEvent(run.ID, protocol.NewLastEvent("", run.ID, time.Now())))
+	err = app.CreateEvent(run.ID, protocol.NewLogEvent("", run.ID, time.Now(), "execute", "stdout", "Too late"))
+	assert.True(t, errors.Is(err, ErrInvalidState))
+	assert.Equal(t, "run is finished: invalid state", err.Error())
+
+	// Cancelling a run that has already finished does nothing
+	assert.Nil(t, app.CancelRun(run.ID))
+}
+
+func TestStartRunFailsCanBeStartedAgain(t *testing.T) {
+	app, job := newQueueingApp(0, 0)
+	job.ExpectedCalls = nil
+	notAllowed := jobdispatcher.RunScheduling{PriorityClass: "urgent"}
+	job.On("CheckScheduling", notAllowed).Return(jobdispatcher.ErrSchedulingNotAllowed)
+	job.On("CheckScheduling", jobdispatcher.RunScheduling{}).Return(nil)
+	job.On("Create", mock.Anything, mock.Anything).Return(errors.New("Something went wrong")).Once()
+	job.On("Create", mock.Anything, mock.Anything).Return(nil)
+
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, putEmptyApp(app, run.ID))
+
+	// Scheduling that isn't allowed is caught before the run is marked as started
+	err = app.StartRun(run.ID, "image", protocol.StartRunOptions{Scheduling: protocol.Scheduling{PriorityClass: "urgent"}})
+	assert.True(t, errors.Is(err, jobdispatcher.ErrSchedulingNotAllowed))
+	state, err := app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "app_uploaded", state)
+
+	// If the job can't be created the run goes back to not being started
+	err = app.StartRun(run.ID, "image", protocol.StartRunOptions{})
+	assert.EqualError(t, err, "Something went wrong")
+	state, err = app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "app_uploaded", state)
+
+	assert.Nil(t, app.StartRun(run.ID, "image", protocol.StartRunOptions{}))
+	state, err = app.getState(run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "started", state)
+	job.AssertExpectations(t)
+}
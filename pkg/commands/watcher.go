@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+// The exit code used in a synthesized finish event because we don't know the real one
+const unknownExitCode = -1
+
+// handleJobFinished gets called by the job dispatcher whenever a job stops running
+func (app *AppImplementation) handleJobFinished(runID string, status jobdispatcher.Status) {
+	err := app.finishRun(runID, status.State)
+	if err != nil {
+		log.Printf("Run %v: couldn't finish after the job stopped: %v", runID, err)
+	}
+}
+
+// finishRun makes sure that a run which has stopped has a finish and last event. Normally
+// the run sends these itself. However if it was killed (for instance because it used too
+// much memory or ran out of time) it won't have. So, we create the missing events on its
+// behalf. Otherwise anyone waiting for the events would wait forever. reason says why the
+// run didn't finish normally.
+func (app *AppImplementation) finishRun(runID string, reason string) error {
+	// Don't do anything if the run has already been cleaned up
+	created, err := app.IsRunCreated(runID)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	var finished bool
+	err = app.newExitDataFinishedKey(runID).get(&finished)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if finished {
+		return nil
+	}
+
+	// If a stage was started but not finished then finish it
+	var stage string
+	err = app.newStageKey(runID).get(&stage)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if stage != "" {
+		exitData, err := app.getExitDataStage(runID, stage)
+		if err != nil {
+			return err
+		}
+		if exitData == nil {
+			event := protocol.NewFinishEvent("", runID, time.Now(), stage, protocol.ExitDataStage{ExitCode: unknownExitCode})
+			err = app.CreateEvent(runID, event)
+			if err != nil {
+				return ignoreInvalidState(err)
+			}
+		}
+	}
+	return ignoreInvalidState(app.CreateEvent(runID, protocol.NewLastEventWithReason("", runID, time.Now(), reason)))
+}
+
+// ignoreInvalidState is for when the run finishing by itself at the same time as we finish it is
+// not a problem
+func ignoreInvalidState(err error) error {
+	if errors.Is(err, ErrInvalidState) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openaustralia/yinyo/pkg/blobstore"
+	"github.com/openaustralia/yinyo/pkg/integrationclient"
+	"github.com/openaustralia/yinyo/pkg/jobdispatcher"
+	"github.com/openaustralia/yinyo/pkg/keyvaluestore"
+	"github.com/openaustralia/yinyo/pkg/protocol"
+	"github.com/openaustralia/yinyo/pkg/stream"
+)
+
+// Creates a run that has been started using in-memory backends (and a temporary directory
+// for the blob store). Call cleanup when done.
+func newStartedRunInMemory(t *testing.T) (app *AppImplementation, runID string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	blobStore, err := blobstore.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app = &AppImplementation{
+		integrationClient: &integrationclient.Client{},
+		BlobStore:         blobStore,
+		Stream:            stream.NewMemory(),
+		KeyValueStore:     keyvaluestore.NewMemory(),
+	}
+	run, err := app.CreateRun(protocol.CreateRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putEmptyApp(app, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// This is what starting the run does apart from creating a job which isn't needed here
+	assert.Nil(t, app.transition(run.ID, stateStarted, stateAppUploaded))
+	assert.Nil(t, app.newCallbackKey(run.ID).set(""))
+	assert.Nil(t, app.newMemoryKey(run.ID).set(1073741824))
+	return app, run.ID, cleanup
+}
+
+func getAllEvents(t *testing.T, app *AppImplementation, runID string) []protocol.Event {
+	var all []protocol.Event
+	events := app.GetEvents(runID, EventsOptions{LastID: "0", Follow: true})
+	defer events.Close()
+	for events.More() {
+		e, err := events.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, e)
+	}
+	return all
+}
+
+// waitForEventsArchive waits for the events of a finished run to be archived in the background
+func waitForEventsArchive(t *testing.T, app *AppImplementation, runID string) {
+	assert.Eventually(t, func() bool {
+		var filename string
+		return app.newEventsArchiveKey(runID).get(&filename) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHandleJobFinishedDuringBuild(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewStartEvent("", runID, time, "build")))
+
+	app.handleJobFinished(runID, jobdispatcher.Status{State: jobdispatcher.StateDeadlineExceeded})
+
+	events := getAllEvents(t, app, runID)
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, protocol.FinishData{Stage: "build", ExitData: protocol.ExitDataStage{ExitCode: -1}}, events[2].Data)
+		assert.Equal(t, protocol.LastData{Reason: "deadline_exceeded"}, events[3].Data)
+	}
+
+	e, err := app.GetExitData(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.ExitData{
+		Build:    &protocol.ExitDataStage{ExitCode: -1},
+		Finished: true,
+		Reason:   "deadline_exceeded",
+	}, e)
+}
+
+func TestHandleJobFinishedBeforeFirstEvent(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+
+	app.handleJobFinished(runID, jobdispatcher.Status{State: jobdispatcher.StateFailed})
+
+	events := getAllEvents(t, app, runID)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, protocol.LastData{Reason: "failed"}, events[0].Data)
+	}
+}
+
+func TestHandleJobFinishedAfterLastEvent(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+
+	time := time.Date(2020, 3, 11, 15, 24, 30, 0, time.UTC)
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFirstEvent("", runID, time)))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewStartEvent("", runID, time, "build")))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewFinishEvent("", runID, time, "build", protocol.ExitDataStage{})))
+	assert.Nil(t, app.CreateEvent(runID, protocol.NewLastEvent("", runID, time)))
+
+	// The run told us itself that it finished so nothing more should happen
+	app.handleJobFinished(runID, jobdispatcher.Status{State: jobdispatcher.StateSucceeded})
+
+	assert.Len(t, getAllEvents(t, app, runID), 4)
+	e, err := app.GetExitData(runID)
+	assert.Nil(t, err)
+	assert.Equal(t, "", e.Reason)
+}
+
+func TestHandleJobFinishedRunDeleted(t *testing.T) {
+	app, runID, cleanup := newStartedRunInMemory(t)
+	defer cleanup()
+	assert.Nil(t, app.deleteAllKeys(runID))
+	assert.Nil(t, app.newCreatedKey(runID).delete())
+
+	app.handleJobFinished(runID, jobdispatcher.Status{State: jobdispatcher.StateFailed})
+
+	var finished bool
+	err := app.newExitDataFinishedKey(runID).get(&finished)
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
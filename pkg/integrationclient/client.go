@@ -32,7 +32,9 @@ func (client *Client) Authenticate(runID string, apiKey string) error {
 	if client.authenticationURL != "" {
 		v := url.Values{}
 		v.Add("api_key", apiKey)
-		v.Add("run_id", runID)
+		if runID != "" {
+			v.Add("run_id", runID)
+		}
 		url := client.authenticationURL + "?" + v.Encode()
 		log.Printf("Making an authentication request to %v", url)
 
@@ -64,14 +66,24 @@ func (client *Client) Authenticate(runID string, apiKey string) error {
 	return nil
 }
 
-func (client *Client) ResourcesAllowed(runID string, memory int64, maxRunTime int64) error {
-	// Now check if the user is allowed the memory and the time
+// AuthenticateAPIKey checks an API key that is being used for something other than a
+// particular run. If authentication is being used there has to be a key.
+func (client *Client) AuthenticateAPIKey(apiKey string) error {
+	if client.authenticationURL != "" && apiKey == "" {
+		return fmt.Errorf("%w: no API key", ErrNotAllowed)
+	}
+	return client.Authenticate("", apiKey)
+}
+
+func (client *Client) ResourcesAllowed(runID string, memory int64, maxRunTime int64, cpu int64) error {
+	// Now check if the user is allowed the memory, the time and the cpu
 	// to start this run
 	if client.resourcesAllowedURL != "" {
 		v := url.Values{}
 		v.Add("run_id", runID)
 		v.Add("time", fmt.Sprint(maxRunTime))
 		v.Add("memory", fmt.Sprint(memory))
+		v.Add("cpu", fmt.Sprint(cpu))
 		url := client.resourcesAllowedURL + "?" + v.Encode()
 		log.Printf("Making a resources allowed request to %v", url)
 
@@ -1,7 +1,62 @@
 package jobdispatcher
 
+import "errors"
+
 // Jobs is the interface to creating jobs
 type Jobs interface {
-	Create(runID string, dockerImage string, command []string, maxRunTime int64, memory int64) error
+	// CheckScheduling returns an error if the scheduling for an individual job isn't allowed.
+	// Create does the same check but this lets it be done before anything else happens.
+	CheckScheduling(scheduling RunScheduling) error
+	Create(runID string, options CreateOptions) error
 	Delete(runID string) error
+	GetStatus(runID string) (Status, error)
+	Watch(handler WatchHandler) error
+}
+
+// CreateOptions are the options for creating a job
+type CreateOptions struct {
+	DockerImage string
+	Command     []string
+	// Environment variables for the run. These are kept out of the command because they can
+	// contain secrets. They are made available to the wrapper as a directory with a file
+	// for each variable
+	Env map[string]string
+	// The maximum number of seconds that the job is allowed to take. If it exceeds this limit it will get stopped automatically
+	MaxRunTime int64
+	// The amount of memory (in bytes) that is allocated to the job. If more is used it will get killed
+	Memory int64
+	// The maximum amount of CPU (in millicores) that the job can use
+	CPU int64
+	// Where and how this particular job is run. What can be chosen here is limited by the scheduling
+	// that the job dispatcher was configured with
+	Scheduling RunScheduling
+	// Labels for this particular job. These are added to the labels that all jobs get.
+	Labels map[string]string
+}
+
+// WatchHandler is called when a job has stopped running, whether that's because it succeeded,
+// failed or ran out of time. It might get called more than once for the same job.
+type WatchHandler func(runID string, status Status)
+
+// Status is the current state of a job and how many times it has been restarted
+type Status struct {
+	State    string
+	Restarts int32
 }
+
+// The possible states of a job
+const (
+	StatePending          = "pending"
+	StateRunning          = "running"
+	StateSucceeded        = "succeeded"
+	StateFailed           = "failed"
+	StateDeadlineExceeded = "deadline_exceeded"
+)
+
+// Finished returns true if the job isn't running anymore and won't be restarted
+func (status Status) Finished() bool {
+	return status.State == StateSucceeded || status.State == StateFailed || status.State == StateDeadlineExceeded
+}
+
+// ErrNotFound is returned when a job doesn't exist
+var ErrNotFound = errors.New("job not found")
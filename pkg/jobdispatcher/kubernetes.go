@@ -1,22 +1,29 @@
 package jobdispatcher
 
 import (
+	"fmt"
+	"log"
+	"time"
+
 	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
 type kubernetesClient struct {
-	clientset *kubernetes.Clientset
-	namespace string
+	clientset  *kubernetes.Clientset
+	namespace  string
+	scheduling Scheduling
 }
 
-// NewKubernetes returns the Kubernetes implementation of Client
-func NewKubernetes(namespace string) (Jobs, error) {
+// NewKubernetes returns the Kubernetes implementation of Client. All the jobs are created in namespace
+// and are scheduled as configured by scheduling
+func NewKubernetes(namespace string, scheduling Scheduling) (Jobs, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, err
@@ -25,45 +32,101 @@ func NewKubernetes(namespace string) (Jobs, error) {
 	if err != nil {
 		return nil, err
 	}
-	k := &kubernetesClient{clientset: clientset, namespace: namespace}
+	k := &kubernetesClient{clientset: clientset, namespace: namespace, scheduling: scheduling}
 	return k, nil
 }
 
-// maxRunTime is the maximum number of seconds that the job is allowed to take. If it exceeds this limit it will get stopped automatically
-// memory is the amount of memory (in bytes) that is allocated to this job. If more is used it will get killed. Note that this
-// memory is effectively reserved for a job so allocating too much if it's not used is wasteful.
-func (client *kubernetesClient) Create(runID string, dockerImage string, command []string, maxRunTime int64, memory int64) error {
+// CheckScheduling returns an error if the scheduling for an individual job isn't allowed
+func (client *kubernetesClient) CheckScheduling(scheduling RunScheduling) error {
+	return client.scheduling.check(scheduling)
+}
+
+// Note that the memory is effectively reserved for a job so allocating too much if it's not used is wasteful.
+// On the other hand only a quarter of the CPU is reserved for the job.
+func (client *kubernetesClient) Create(runID string, options CreateOptions) error {
+	err := client.CheckScheduling(options.Scheduling)
+	if err != nil {
+		return err
+	}
 	jobsClient := client.clientset.BatchV1().Jobs(client.namespace)
 
 	autoMountServiceAccountToken := false
 	// Allow the job to get restarted up to 5 times before it's considered failed
 	backOffLimit := int32(5)
-	memoryQuantity := resource.NewQuantity(memory, resource.BinarySI)
+	memoryQuantity := resource.NewQuantity(options.Memory, resource.BinarySI)
+	cpuLimitQuantity := resource.NewMilliQuantity(options.CPU, resource.DecimalSI)
+	cpuRequestQuantity := resource.NewMilliQuantity(options.CPU/4, resource.DecimalSI)
+
+	var tolerations []apiv1.Toleration
+	for _, t := range client.scheduling.Tolerations {
+		tolerations = append(tolerations, apiv1.Toleration{
+			Key:               t.Key,
+			Operator:          apiv1.TolerationOperator(t.Operator),
+			Value:             t.Value,
+			Effect:            apiv1.TaintEffect(t.Effect),
+			TolerationSeconds: t.TolerationSeconds,
+		})
+	}
+	var runtimeClassName *string
+	if client.scheduling.RuntimeClass != "" {
+		runtimeClassName = &client.scheduling.RuntimeClass
+	}
+
+	// Each environment variable shows up as a file in the directory where the secret is mounted
+	var volumes []apiv1.Volume
+	var volumeMounts []apiv1.VolumeMount
+	if len(options.Env) > 0 {
+		err = client.createEnvSecret(runID, options.Env)
+		if err != nil {
+			return err
+		}
+		volumes = []apiv1.Volume{{
+			Name: "env",
+			VolumeSource: apiv1.VolumeSource{
+				Secret: &apiv1.SecretVolumeSource{SecretName: runID},
+			},
+		}}
+		volumeMounts = []apiv1.VolumeMount{{Name: "env", MountPath: envPath, ReadOnly: true}}
+	}
 
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: runID,
+			// The labels for the individual job only go on the job and not on its pods so
+			// that they can't be used to match things like network policies
+			Labels:      client.scheduling.labels(options.Labels),
+			Annotations: client.scheduling.Annotations,
 		},
 		Spec: batchv1.JobSpec{
 			BackoffLimit:          &backOffLimit,
-			ActiveDeadlineSeconds: &maxRunTime,
+			ActiveDeadlineSeconds: &options.MaxRunTime,
 			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      client.scheduling.Labels,
+					Annotations: client.scheduling.Annotations,
+				},
 				Spec: apiv1.PodSpec{
 					AutomountServiceAccountToken: &autoMountServiceAccountToken,
 					RestartPolicy:                "OnFailure",
+					NodeSelector:                 client.scheduling.nodeSelector(options.Scheduling),
+					Tolerations:                  tolerations,
+					PriorityClassName:            client.scheduling.priorityClass(options.Scheduling),
+					RuntimeClassName:             runtimeClassName,
+					Volumes:                      volumes,
 					Containers: []apiv1.Container{
 						{
-							Name:    runID,
-							Image:   dockerImage,
-							Command: command,
+							Name:         runID,
+							Image:        options.DockerImage,
+							Command:      options.Command,
+							VolumeMounts: volumeMounts,
 							Resources: apiv1.ResourceRequirements{
 								Requests: apiv1.ResourceList{
 									apiv1.ResourceMemory: *memoryQuantity,
-									apiv1.ResourceCPU:    resource.MustParse("250m"), // 1/4 of a vCPU
+									apiv1.ResourceCPU:    *cpuRequestQuantity,
 								},
 								Limits: apiv1.ResourceList{
 									apiv1.ResourceMemory: *memoryQuantity,
-									apiv1.ResourceCPU:    resource.MustParse("1000m"), // One vCPU
+									apiv1.ResourceCPU:    *cpuLimitQuantity,
 								},
 							},
 						},
@@ -72,8 +135,17 @@ func (client *kubernetesClient) Create(runID string, dockerImage string, command
 			},
 		},
 	}
-	_, err := jobsClient.Create(job)
-	return err
+	_, err = jobsClient.Create(job)
+	if err != nil {
+		// Don't leave the secret lying around
+		if len(options.Env) > 0 {
+			//nolint:errcheck // we're already returning the more important error
+			//skipcq: GSC-G104
+			client.deleteEnvSecret(runID)
+		}
+		return err
+	}
+	return nil
 }
 
 func (client *kubernetesClient) Delete(runID string) error {
@@ -83,12 +155,139 @@ func (client *kubernetesClient) Delete(runID string) error {
 	err := jobsClient.Delete(runID, &metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	})
+	// Don't error if it's just that the job doesn't exist
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return client.deleteEnvSecret(runID)
+}
+
+// The wrapper expects to find the environment variables here
+const envPath = "/tmp/env"
+
+// createEnvSecret stores the environment variables for a run in a secret so that they
+// don't show up in the job. The secret has the same name as the job.
+func (client *kubernetesClient) createEnvSecret(runID string, env map[string]string) error {
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: runID,
+		},
+		Type:       apiv1.SecretTypeOpaque,
+		StringData: env,
+	}
+	_, err := client.clientset.CoreV1().Secrets(client.namespace).Create(secret)
+	return err
+}
+
+func (client *kubernetesClient) deleteEnvSecret(runID string) error {
+	err := client.clientset.CoreV1().Secrets(client.namespace).Delete(runID, &metav1.DeleteOptions{})
+	// Runs without any environment variables don't have a secret
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// GetStatus figures out the state of the job from the job itself and its pods
+func (client *kubernetesClient) GetStatus(runID string) (Status, error) {
+	var status Status
+	job, err := client.clientset.BatchV1().Jobs(client.namespace).Get(runID, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return status, fmt.Errorf("%w: %v", ErrNotFound, runID)
+		}
+		return status, err
+	}
+	status.State = jobState(job)
+	// Pods that failed completely were replaced by a new pod
+	status.Restarts = job.Status.Failed
+
+	pods, err := client.clientset.CoreV1().Pods(client.namespace).List(metav1.ListOptions{
+		LabelSelector: "job-name=" + runID,
+	})
 	if err != nil {
-		// Don't error if it's just that the job doesn't exist
-		if err.(*apierrors.StatusError).ErrStatus.Reason == metav1.StatusReasonNotFound {
-			return nil
+		return status, err
+	}
+	running := false
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == apiv1.PodRunning {
+			running = true
+		}
+		// Containers that failed were restarted inside the same pod
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			status.Restarts += containerStatus.RestartCount
 		}
+	}
+	if status.State == "" {
+		if running {
+			status.State = StateRunning
+		} else {
+			status.State = StatePending
+		}
+	}
+	return status, nil
+}
+
+// jobState returns the state of a job that has finished or an empty string if it hasn't finished yet
+func jobState(job *batchv1.Job) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return StateSucceeded
+		case batchv1.JobFailed:
+			if condition.Reason == "DeadlineExceeded" {
+				return StateDeadlineExceeded
+			}
+			return StateFailed
+		}
+	}
+	return ""
+}
+
+// How long to wait before trying to watch the jobs again after something went wrong
+const kubernetesWatchRetryInterval = 5 * time.Second
+
+// Watch watches the jobs in the background and calls handler for every job that has finished.
+// When the watch is (re)started handler also gets called for all jobs that finished earlier.
+func (client *kubernetesClient) Watch(handler WatchHandler) error {
+	// Check that we can watch jobs at all so that a problem is reported straight away
+	watcher, err := client.clientset.BatchV1().Jobs(client.namespace).Watch(metav1.ListOptions{})
+	if err != nil {
 		return err
 	}
+	go func() {
+		for {
+			handleJobEvents(watcher, handler)
+			// The API server closes watches regularly so we just start again
+			for {
+				watcher, err = client.clientset.BatchV1().Jobs(client.namespace).Watch(metav1.ListOptions{})
+				if err == nil {
+					break
+				}
+				log.Printf("Couldn't watch jobs: %v", err)
+				time.Sleep(kubernetesWatchRetryInterval)
+			}
+		}
+	}()
 	return nil
 }
+
+func handleJobEvents(watcher watch.Interface, handler WatchHandler) {
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		if event.Type != watch.Added && event.Type != watch.Modified {
+			continue
+		}
+		job, ok := event.Object.(*batchv1.Job)
+		if !ok {
+			continue
+		}
+		state := jobState(job)
+		if state != "" {
+			handler(job.Name, Status{State: state, Restarts: job.Status.Failed})
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package jobdispatcher
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Allow the job to get restarted up to 5 times before it's considered failed. This
+// mirrors the back off limit used for Kubernetes jobs
+const localBackOffLimit = 5
+
+// How often the memory used by a running job is checked
+const localMemoryCheckInterval = time.Second
+
+type localClient struct {
+	wrapperPath  string
+	workDir      string
+	buildCommand string
+	runCommand   string
+	mutex        sync.Mutex
+	jobs         map[string]*localJob
+	handlers     []WatchHandler
+}
+
+type localJob struct {
+	// Closing this stops the job
+	stop chan struct{}
+	// This is closed when the job is no longer running
+	done   chan struct{}
+	mutex  sync.Mutex
+	status Status
+}
+
+func (job *localJob) getStatus() Status {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	return job.status
+}
+
+func (job *localJob) setState(state string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.status.State = state
+}
+
+func (job *localJob) restarted() {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.status.Restarts++
+}
+
+// NewLocal returns an implementation of Jobs that runs each job as a process on the local machine
+// rather than in a container. This is useful for development and testing because it doesn't need
+// Kubernetes. wrapperPath is the path to the wrapper binary. If empty the binary given in the command
+// is used. Each job gets its own directory inside workDir. buildCommand and runCommand optionally
+// override the commands that the wrapper uses to build and run a scraper.
+func NewLocal(wrapperPath string, workDir string, buildCommand string, runCommand string) (Jobs, error) {
+	if workDir == "" {
+		workDir = filepath.Join(os.TempDir(), "yinyo")
+	}
+	err := os.MkdirAll(workDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &localClient{
+		wrapperPath:  wrapperPath,
+		workDir:      workDir,
+		buildCommand: buildCommand,
+		runCommand:   runCommand,
+		jobs:         make(map[string]*localJob),
+	}, nil
+}
+
+func (client *localClient) jobDir(runID string) (string, error) {
+	// Make sure that the run ID can't be used to escape the work directory
+	if runID == "" || runID == "." || runID == ".." || runID != filepath.Base(runID) {
+		return "", fmt.Errorf("invalid run ID %q", runID)
+	}
+	return filepath.Join(client.workDir, runID), nil
+}
+
+// The command is run with the same arguments as it would be in a container except that
+// all the paths used by the wrapper are moved into a directory that is unique to this job
+func (client *localClient) command(dir string, command []string) *exec.Cmd {
+	name := client.wrapperPath
+	if name == "" {
+		name = command[0]
+	}
+	args := append([]string{}, command[1:]...)
+	args = append(args,
+		"--apppath", filepath.Join(dir, "app"),
+		"--importpath", filepath.Join(dir, "import"),
+		"--cachepath", filepath.Join(dir, "cache"),
+		"--envpath", filepath.Join(dir, "env"),
+	)
+	if client.buildCommand != "" {
+		args = append(args, "--buildcommand", client.buildCommand)
+	}
+	if client.runCommand != "" {
+		args = append(args, "--runcommand", client.runCommand)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Put the wrapper and everything it starts in its own process group so that
+	// we can measure and kill all of them together
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// CheckScheduling always succeeds because the scheduling is ignored
+func (client *localClient) CheckScheduling(scheduling RunScheduling) error {
+	return nil
+}
+
+// Memory is only measured on systems which have /proc. Elsewhere it is ignored. If more is used the processes of
+// the job get killed and restarted. The docker image, cpu and scheduling are ignored.
+func (client *localClient) Create(runID string, options CreateOptions) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if _, ok := client.jobs[runID]; ok {
+		return fmt.Errorf("job %v already exists", runID)
+	}
+	dir, err := client.jobDir(runID)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	err = writeEnv(filepath.Join(dir, "env"), options.Env)
+	if err != nil {
+		return err
+	}
+	// Start the first attempt here so that we can return an error if the command can't be started at all
+	cmd := client.command(dir, options.Command)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	job := &localJob{stop: make(chan struct{}), done: make(chan struct{}), status: Status{State: StateRunning}}
+	client.jobs[runID] = job
+	go client.supervise(runID, dir, options.Command, cmd, job, time.Duration(options.MaxRunTime)*time.Second, options.Memory)
+	return nil
+}
+
+// supervise waits for the job to finish. It restarts it if it fails and kills it if
+// it runs out of time, uses too much memory or is stopped.
+func (client *localClient) supervise(runID string, dir string, command []string, cmd *exec.Cmd, job *localJob, maxRunTime time.Duration, memory int64) {
+	defer close(job.done)
+	defer client.finished(runID, job)
+
+	// The deadline applies to all the attempts together
+	timer := time.NewTimer(maxRunTime)
+	defer timer.Stop()
+	ticker := time.NewTicker(localMemoryCheckInterval)
+	defer ticker.Stop()
+
+	for restarts := 0; ; restarts++ {
+		if restarts > 0 {
+			job.restarted()
+			cmd = client.command(dir, command)
+			if err := cmd.Start(); err != nil {
+				log.Printf("Job %v: couldn't restart: %v", runID, err)
+				job.setState(StateFailed)
+				return
+			}
+		}
+		exited := make(chan error, 1)
+		go func(cmd *exec.Cmd) {
+			exited <- cmd.Wait()
+		}(cmd)
+
+		err := waitForProcess(cmd, exited, job.stop, timer.C, ticker.C, memory)
+		if errors.Is(err, errStopped) {
+			return
+		}
+		if errors.Is(err, errDeadlineExceeded) {
+			log.Printf("Job %v: exceeded its maximum run time", runID)
+			job.setState(StateDeadlineExceeded)
+			return
+		}
+		if err == nil {
+			job.setState(StateSucceeded)
+			return
+		}
+		log.Printf("Job %v: %v", runID, err)
+		if restarts >= localBackOffLimit {
+			log.Printf("Job %v: failed after %v restarts", runID, restarts)
+			job.setState(StateFailed)
+			return
+		}
+	}
+}
+
+// writeEnv writes each environment variable to its own file in dir which is where the
+// wrapper picks them up from
+func writeEnv(dir string, env map[string]string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	for name, value := range env {
+		if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errStopped = errors.New("stopped")
+var errDeadlineExceeded = errors.New("deadline exceeded")
+
+// waitForProcess returns nil if the process exited successfully
+func waitForProcess(cmd *exec.Cmd, exited <-chan error, stop <-chan struct{}, deadline <-chan time.Time, tick <-chan time.Time, memory int64) error {
+	for {
+		select {
+		case err := <-exited:
+			return err
+		case <-stop:
+			killProcessGroup(cmd, exited)
+			return errStopped
+		case <-deadline:
+			killProcessGroup(cmd, exited)
+			return errDeadlineExceeded
+		case <-tick:
+			used, err := processGroupMemory(cmd.Process.Pid)
+			// If we can't measure memory on this system just don't enforce it
+			if err == nil && memory > 0 && used > uint64(memory) {
+				killProcessGroup(cmd, exited)
+				return fmt.Errorf("killed because it used %v bytes of memory which is more than the %v allowed", used, memory)
+			}
+		}
+	}
+}
+
+func killProcessGroup(cmd *exec.Cmd, exited <-chan error) {
+	// A negative pid sends the signal to the whole process group
+	//nolint:errcheck // the process might already have gone away
+	//skipcq: GSC-G104
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	<-exited
+}
+
+// processGroupMemory returns the total resident memory (in bytes) of all the processes in a process group
+func processGroupMemory(pgid int) (uint64, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) == 0 {
+		return 0, errors.New("can't read processes from /proc")
+	}
+	var total uint64
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			// The process probably exited since we listed it
+			continue
+		}
+		// The second field (the command name) can contain spaces so we skip
+		// past it before splitting. The remaining fields start with the third.
+		s := string(b)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		// Field 5 is the process group and field 24 is the resident set size in pages
+		if len(fields) < 22 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		rss, err := strconv.ParseUint(fields[21], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += rss * uint64(os.Getpagesize())
+	}
+	return total, nil
+}
+
+func (client *localClient) Delete(runID string) error {
+	client.mutex.Lock()
+	job, ok := client.jobs[runID]
+	delete(client.jobs, runID)
+	client.mutex.Unlock()
+
+	// Don't error if it's just that the job doesn't exist
+	if ok {
+		close(job.stop)
+		<-job.done
+	}
+	dir, err := client.jobDir(runID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (client *localClient) GetStatus(runID string) (Status, error) {
+	client.mutex.Lock()
+	job, ok := client.jobs[runID]
+	client.mutex.Unlock()
+
+	if !ok {
+		return Status{}, fmt.Errorf("%w: %v", ErrNotFound, runID)
+	}
+	return job.getStatus(), nil
+}
+
+// Watch calls handler whenever a job finishes. Jobs that are stopped by being deleted don't count.
+func (client *localClient) Watch(handler WatchHandler) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.handlers = append(client.handlers, handler)
+	return nil
+}
+
+func (client *localClient) finished(runID string, job *localJob) {
+	status := job.getStatus()
+	if !status.Finished() {
+		return
+	}
+	client.mutex.Lock()
+	handlers := append([]WatchHandler{}, client.handlers...)
+	client.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(runID, status)
+	}
+}
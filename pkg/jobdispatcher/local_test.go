@@ -0,0 +1,214 @@
+package jobdispatcher
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a local job dispatcher which runs the given shell script instead of the wrapper
+func newLocalWithScript(t *testing.T, script string) (*localClient, string) {
+	dir, err := ioutil.TempDir("", "yinyo-local-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapperPath := filepath.Join(dir, "wrapper.sh")
+	err = ioutil.WriteFile(wrapperPath, []byte("#!/bin/sh\n"+script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := NewLocal(wrapperPath, filepath.Join(dir, "work"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs.(*localClient), dir
+}
+
+func waitForJob(t *testing.T, client *localClient, runID string) {
+	client.mutex.Lock()
+	job := client.jobs[runID]
+	client.mutex.Unlock()
+	select {
+	case <-job.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job didn't finish in time")
+	}
+}
+
+func TestLocalCreate(t *testing.T) {
+	client, dir := newLocalWithScript(t, `echo "$@" > `+"../args\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper", "run-name", "--output", "output.txt"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	waitForJob(t, client, "run-name")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "work", "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobDir := filepath.Join(dir, "work", "run-name")
+	assert.Equal(t, "run-name --output output.txt"+
+		" --apppath "+jobDir+"/app --importpath "+jobDir+"/import"+
+		" --cachepath "+jobDir+"/cache --envpath "+jobDir+"/env\n", string(b))
+}
+
+func TestLocalCreateEnv(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60, Env: map[string]string{"FOO": "bar"}})
+	assert.Nil(t, err)
+	waitForJob(t, client, "run-name")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "work", "run-name", "env", "FOO"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", string(b))
+}
+
+func TestLocalCreateInvalidEnv(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60, Env: map[string]string{"../FOO": "bar"}})
+	assert.EqualError(t, err, `invalid environment variable name "../FOO"`)
+}
+
+func TestLocalCreateTwice(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	err = client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.EqualError(t, err, "job run-name already exists")
+}
+
+func TestLocalCreateInvalidRunID(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("../foo", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.EqualError(t, err, `invalid run ID "../foo"`)
+}
+
+func TestLocalRestartsOnFailure(t *testing.T) {
+	client, dir := newLocalWithScript(t, "echo attempt >> ../attempts\nexit 1\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	waitForJob(t, client, "run-name")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "work", "attempts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first attempt and then all the restarts
+	assert.Equal(t, localBackOffLimit+1, strings.Count(string(b), "attempt"))
+
+	status, err := client.GetStatus("run-name")
+	assert.Nil(t, err)
+	assert.Equal(t, Status{State: StateFailed, Restarts: localBackOffLimit}, status)
+}
+
+func TestLocalMaxRunTime(t *testing.T) {
+	client, dir := newLocalWithScript(t, "sleep 60\n")
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 1})
+	assert.Nil(t, err)
+	waitForJob(t, client, "run-name")
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	status, err := client.GetStatus("run-name")
+	assert.Nil(t, err)
+	assert.Equal(t, Status{State: StateDeadlineExceeded}, status)
+}
+
+func TestLocalGetStatus(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	waitForJob(t, client, "run-name")
+
+	status, err := client.GetStatus("run-name")
+	assert.Nil(t, err)
+	assert.Equal(t, Status{State: StateSucceeded}, status)
+}
+
+func TestLocalGetStatusDoesNotExist(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	_, err := client.GetStatus("does-not-exist")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestLocalWatch(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 1\n")
+	defer os.RemoveAll(dir)
+
+	var runIDs []string
+	var statuses []Status
+	err := client.Watch(func(runID string, status Status) {
+		runIDs = append(runIDs, runID)
+		statuses = append(statuses, status)
+	})
+	assert.Nil(t, err)
+	err = client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	waitForJob(t, client, "run-name")
+
+	assert.Equal(t, []string{"run-name"}, runIDs)
+	assert.Equal(t, []Status{{State: StateFailed, Restarts: localBackOffLimit}}, statuses)
+}
+
+func TestLocalWatchDelete(t *testing.T) {
+	client, dir := newLocalWithScript(t, "sleep 60\n")
+	defer os.RemoveAll(dir)
+
+	called := false
+	err := client.Watch(func(runID string, status Status) {
+		called = true
+	})
+	assert.Nil(t, err)
+	err = client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	err = client.Delete("run-name")
+	assert.Nil(t, err)
+
+	// Deleting a job doesn't count as it finishing
+	assert.False(t, called)
+}
+
+func TestLocalDelete(t *testing.T) {
+	client, dir := newLocalWithScript(t, "sleep 60\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Create("run-name", CreateOptions{DockerImage: "image", Command: []string{"/bin/wrapper"}, MaxRunTime: 60})
+	assert.Nil(t, err)
+	err = client.Delete("run-name")
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "work", "run-name"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, client.jobs)
+}
+
+func TestLocalDeleteDoesNotExist(t *testing.T) {
+	client, dir := newLocalWithScript(t, "exit 0\n")
+	defer os.RemoveAll(dir)
+
+	err := client.Delete("does-not-exist")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,120 @@
+package jobdispatcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Scheduling configures where and how all jobs are run. For instance, this can be used to keep
+// the jobs on their own nodes. It also says what can be chosen for an individual job.
+type Scheduling struct {
+	NodeSelector  map[string]string `json:"node_selector"`
+	Tolerations   []Toleration      `json:"tolerations"`
+	Labels        map[string]string `json:"labels"`
+	Annotations   map[string]string `json:"annotations"`
+	PriorityClass string            `json:"priority_class"`
+	RuntimeClass  string            `json:"runtime_class"`
+	// The keys of the node selector that can be set for an individual job
+	AllowedNodeSelectorKeys []string `json:"allowed_node_selector_keys"`
+	// The priority classes that can be picked for an individual job
+	AllowedPriorityClasses []string `json:"allowed_priority_classes"`
+}
+
+// Toleration allows jobs to run on nodes with a matching taint
+type Toleration struct {
+	Key               string `json:"key"`
+	Operator          string `json:"operator"`
+	Value             string `json:"value"`
+	Effect            string `json:"effect"`
+	TolerationSeconds *int64 `json:"toleration_seconds"`
+}
+
+// RunScheduling is the part of the scheduling that can be chosen for an individual job
+type RunScheduling struct {
+	NodeSelector  map[string]string
+	PriorityClass string
+}
+
+// ErrSchedulingNotAllowed is returned when a job asks for scheduling that it's not allowed to
+var ErrSchedulingNotAllowed = errors.New("scheduling not allowed")
+
+// ErrInvalidLabels is returned when labels for a job can't be used as Kubernetes labels
+var ErrInvalidLabels = errors.New("invalid labels")
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if the scheduling chosen for an individual job isn't allowed
+func (scheduling Scheduling) check(run RunScheduling) error {
+	for key := range run.NodeSelector {
+		if !contains(scheduling.AllowedNodeSelectorKeys, key) {
+			return fmt.Errorf("%w: node selector %q can not be set", ErrSchedulingNotAllowed, key)
+		}
+	}
+	if run.PriorityClass != "" && !contains(scheduling.AllowedPriorityClasses, run.PriorityClass) {
+		return fmt.Errorf("%w: priority class %q can not be used", ErrSchedulingNotAllowed, run.PriorityClass)
+	}
+	return nil
+}
+
+// nodeSelector combines the node selector for all jobs with the one for an individual job
+func (scheduling Scheduling) nodeSelector(run RunScheduling) map[string]string {
+	if len(scheduling.NodeSelector) == 0 && len(run.NodeSelector) == 0 {
+		return nil
+	}
+	nodeSelector := make(map[string]string)
+	for k, v := range scheduling.NodeSelector {
+		nodeSelector[k] = v
+	}
+	for k, v := range run.NodeSelector {
+		nodeSelector[k] = v
+	}
+	return nodeSelector
+}
+
+// priorityClass returns the priority class picked for an individual job or otherwise the one for all jobs
+func (scheduling Scheduling) priorityClass(run RunScheduling) string {
+	if run.PriorityClass != "" {
+		return run.PriorityClass
+	}
+	return scheduling.PriorityClass
+}
+
+// CheckLabels returns an error if the labels for an individual job can't be used as Kubernetes labels
+func CheckLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("%w: key %q: %v", ErrInvalidLabels, key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("%w: value %q: %v", ErrInvalidLabels, value, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// labels combines the labels for all jobs with the ones for an individual job. Unlike the node
+// selector an individual job can't override the labels for all jobs because they might be
+// relied on by whoever is running yinyo.
+func (scheduling Scheduling) labels(run map[string]string) map[string]string {
+	if len(scheduling.Labels) == 0 && len(run) == 0 {
+		return nil
+	}
+	labels := make(map[string]string)
+	for k, v := range run {
+		labels[k] = v
+	}
+	for k, v := range scheduling.Labels {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,65 @@
+package jobdispatcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulingCheck(t *testing.T) {
+	scheduling := Scheduling{
+		AllowedNodeSelectorKeys: []string{"size"},
+		AllowedPriorityClasses:  []string{"low", "high"},
+	}
+	assert.Nil(t, scheduling.check(RunScheduling{}))
+	assert.Nil(t, scheduling.check(RunScheduling{NodeSelector: map[string]string{"size": "large"}, PriorityClass: "high"}))
+
+	err := scheduling.check(RunScheduling{NodeSelector: map[string]string{"pool": "production"}})
+	assert.True(t, errors.Is(err, ErrSchedulingNotAllowed))
+	assert.EqualError(t, err, `scheduling not allowed: node selector "pool" can not be set`)
+
+	err = scheduling.check(RunScheduling{PriorityClass: "urgent"})
+	assert.EqualError(t, err, `scheduling not allowed: priority class "urgent" can not be used`)
+}
+
+func TestSchedulingNodeSelector(t *testing.T) {
+	scheduling := Scheduling{NodeSelector: map[string]string{"pool": "scrapers", "size": "small"}}
+
+	assert.Nil(t, Scheduling{}.nodeSelector(RunScheduling{}))
+	assert.Equal(t, map[string]string{"pool": "scrapers", "size": "small"}, scheduling.nodeSelector(RunScheduling{}))
+	// The individual job can override the default
+	assert.Equal(t,
+		map[string]string{"pool": "scrapers", "size": "large"},
+		scheduling.nodeSelector(RunScheduling{NodeSelector: map[string]string{"size": "large"}}),
+	)
+}
+
+func TestSchedulingPriorityClass(t *testing.T) {
+	scheduling := Scheduling{PriorityClass: "low"}
+
+	assert.Equal(t, "low", scheduling.priorityClass(RunScheduling{}))
+	assert.Equal(t, "high", scheduling.priorityClass(RunScheduling{PriorityClass: "high"}))
+}
+
+func TestCheckLabels(t *testing.T) {
+	assert.Nil(t, CheckLabels(nil))
+	assert.Nil(t, CheckLabels(map[string]string{"scraper": "planningalerts", "example.com/sha": "abc123", "empty": ""}))
+
+	err := CheckLabels(map[string]string{"not a key": "foo"})
+	assert.True(t, errors.Is(err, ErrInvalidLabels))
+	err = CheckLabels(map[string]string{"scraper": "not a value"})
+	assert.True(t, errors.Is(err, ErrInvalidLabels))
+}
+
+func TestSchedulingLabels(t *testing.T) {
+	scheduling := Scheduling{Labels: map[string]string{"app": "yinyo"}}
+
+	assert.Nil(t, Scheduling{}.labels(nil))
+	assert.Equal(t, map[string]string{"app": "yinyo"}, scheduling.labels(nil))
+	// The individual job can't override the labels for all jobs
+	assert.Equal(t,
+		map[string]string{"app": "yinyo", "scraper": "planningalerts"},
+		scheduling.labels(map[string]string{"app": "other", "scraper": "planningalerts"}),
+	)
+}
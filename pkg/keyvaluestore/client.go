@@ -5,8 +5,40 @@ import "errors"
 // KeyValueStore defines the interface to access the key value store
 type KeyValueStore interface {
 	Set(key string, value string) error
+	// SetIfNotExists atomically sets key to value only if key doesn't already exist.
+	// It returns true if the value was set.
+	SetIfNotExists(key string, value string) (bool, error)
+	// CompareAndSet atomically sets key to value only if it currently holds old.
+	// It returns true if the value was set.
+	CompareAndSet(key string, old string, value string) (bool, error)
 	Get(key string) (string, error)
+	// GetAndDelete atomically gets the value stored at key and deletes it. If the key
+	// doesn't exist it returns ErrKeyNotExist. Only one caller can get any particular value.
+	GetAndDelete(key string) (string, error)
 	Delete(key string) error
+	// Increment atomically adds value to the integer stored at key and returns the result.
+	// If the key doesn't exist it's treated as 0.
+	Increment(key string, value int64) (int64, error)
+	// ListPush adds value to the end of the list stored at key
+	ListPush(key string, value string) error
+	// ListPop removes and returns the value at the start of the list stored at key.
+	// If the list is empty it returns ErrKeyNotExist
+	ListPop(key string) (string, error)
+	ListLength(key string) (int64, error)
+	// SortedSetAdd adds value to the set stored at key. The values in the set are kept in
+	// order of their score.
+	SortedSetAdd(key string, value string, score int64) error
+	// SortedSetRangeAfter returns up to count values from the set stored at key that have a
+	// score greater than after, in order of their score
+	SortedSetRangeAfter(key string, after int64, count int64) ([]ScoredValue, error)
+	// SortedSetRemove removes value from the set stored at key
+	SortedSetRemove(key string, value string) error
+}
+
+// ScoredValue is a value in a sorted set along with its score
+type ScoredValue struct {
+	Value string
+	Score int64
 }
 
 // ErrKeyNotExist is returned when a key doesn't exist
@@ -0,0 +1,186 @@
+package keyvaluestore
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type memoryClient struct {
+	mutex  sync.Mutex
+	values map[string]string
+	lists  map[string][]string
+	sets   map[string][]ScoredValue
+}
+
+// NewMemory returns an implementation of KeyValueStore that keeps everything in memory. It
+// only works when there is a single server and everything is lost when it restarts so
+// it's only really useful for development and testing.
+func NewMemory() KeyValueStore {
+	return &memoryClient{
+		values: make(map[string]string),
+		lists:  make(map[string][]string),
+		sets:   make(map[string][]ScoredValue),
+	}
+}
+
+func (client *memoryClient) Set(key string, value string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.values[namespaced(key)] = value
+	return nil
+}
+
+func (client *memoryClient) SetIfNotExists(key string, value string) (bool, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if _, ok := client.values[namespaced(key)]; ok {
+		return false, nil
+	}
+	client.values[namespaced(key)] = value
+	return true, nil
+}
+
+func (client *memoryClient) CompareAndSet(key string, old string, value string) (bool, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if current, ok := client.values[namespaced(key)]; !ok || current != old {
+		return false, nil
+	}
+	client.values[namespaced(key)] = value
+	return true, nil
+}
+
+func (client *memoryClient) Get(key string) (string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	value, ok := client.values[namespaced(key)]
+	if !ok {
+		return value, ErrKeyNotExist
+	}
+	return value, nil
+}
+
+func (client *memoryClient) GetAndDelete(key string) (string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	value, ok := client.values[namespaced(key)]
+	if !ok {
+		return value, ErrKeyNotExist
+	}
+	delete(client.values, namespaced(key))
+	return value, nil
+}
+
+func (client *memoryClient) Delete(key string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	delete(client.values, namespaced(key))
+	delete(client.lists, namespaced(key))
+	delete(client.sets, namespaced(key))
+	return nil
+}
+
+func (client *memoryClient) Increment(key string, value int64) (int64, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	var current int64
+	if s, ok := client.values[namespaced(key)]; ok {
+		var err error
+		current, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	current += value
+	client.values[namespaced(key)] = strconv.FormatInt(current, 10)
+	return current, nil
+}
+
+func (client *memoryClient) ListPush(key string, value string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.lists[namespaced(key)] = append(client.lists[namespaced(key)], value)
+	return nil
+}
+
+func (client *memoryClient) ListPop(key string) (string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	list := client.lists[namespaced(key)]
+	if len(list) == 0 {
+		return "", ErrKeyNotExist
+	}
+	if len(list) == 1 {
+		delete(client.lists, namespaced(key))
+	} else {
+		client.lists[namespaced(key)] = list[1:]
+	}
+	return list[0], nil
+}
+
+func (client *memoryClient) ListLength(key string) (int64, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return int64(len(client.lists[namespaced(key)])), nil
+}
+
+func (client *memoryClient) SortedSetAdd(key string, value string, score int64) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	set := removeScored(client.sets[namespaced(key)], value)
+	// Keep the set in order of score
+	i := sort.Search(len(set), func(i int) bool { return set[i].Score > score })
+	set = append(set, ScoredValue{})
+	copy(set[i+1:], set[i:])
+	set[i] = ScoredValue{Value: value, Score: score}
+	client.sets[namespaced(key)] = set
+	return nil
+}
+
+func (client *memoryClient) SortedSetRangeAfter(key string, after int64, count int64) ([]ScoredValue, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	set := client.sets[namespaced(key)]
+	i := sort.Search(len(set), func(i int) bool { return set[i].Score > after })
+	values := []ScoredValue{}
+	for ; i < len(set) && int64(len(values)) < count; i++ {
+		values = append(values, set[i])
+	}
+	return values, nil
+}
+
+func (client *memoryClient) SortedSetRemove(key string, value string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	set := removeScored(client.sets[namespaced(key)], value)
+	if len(set) == 0 {
+		delete(client.sets, namespaced(key))
+	} else {
+		client.sets[namespaced(key)] = set
+	}
+	return nil
+}
+
+func removeScored(set []ScoredValue, value string) []ScoredValue {
+	var result []ScoredValue
+	for _, v := range set {
+		if v.Value != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package keyvaluestore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySetGetDelete(t *testing.T) {
+	client := NewMemory()
+
+	err := client.Set("run-name/url", "http://foo.com")
+	assert.Nil(t, err)
+	value, err := client.Get("run-name/url")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://foo.com", value)
+
+	err = client.Delete("run-name/url")
+	assert.Nil(t, err)
+	_, err = client.Get("run-name/url")
+	assert.Equal(t, ErrKeyNotExist, err)
+}
+
+func TestMemoryNamespaced(t *testing.T) {
+	client := NewMemory().(*memoryClient)
+
+	err := client.Set("foo", "bar")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"kv:foo": "bar"}, client.values)
+}
+
+func TestMemoryIncrement(t *testing.T) {
+	client := NewMemory()
+
+	value, err := client.Increment("running", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), value)
+	value, err = client.Increment("running", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), value)
+	value, err = client.Increment("running", -3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), value)
+
+	// The result is stored like any other value
+	s, err := client.Get("running")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", s)
+}
+
+func TestMemoryList(t *testing.T) {
+	client := NewMemory()
+
+	assert.Nil(t, client.ListPush("queue", "a"))
+	assert.Nil(t, client.ListPush("queue", "b"))
+	length, err := client.ListLength("queue")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), length)
+
+	value, err := client.ListPop("queue")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", value)
+	value, err = client.ListPop("queue")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", value)
+	_, err = client.ListPop("queue")
+	assert.Equal(t, ErrKeyNotExist, err)
+	length, err = client.ListLength("queue")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), length)
+}
+
+func TestMemorySetIfNotExists(t *testing.T) {
+	client := NewMemory()
+
+	set, err := client.SetIfNotExists("run-name/created", "true")
+	assert.Nil(t, err)
+	assert.True(t, set)
+	set, err = client.SetIfNotExists("run-name/created", "false")
+	assert.Nil(t, err)
+	assert.False(t, set)
+
+	value, err := client.Get("run-name/created")
+	assert.Nil(t, err)
+	assert.Equal(t, "true", value)
+}
+
+func TestMemoryCompareAndSet(t *testing.T) {
+	client := NewMemory()
+
+	// Nothing happens if the key doesn't exist
+	set, err := client.CompareAndSet("run-name/slot", "true", "false")
+	assert.Nil(t, err)
+	assert.False(t, set)
+	_, err = client.Get("run-name/slot")
+	assert.Equal(t, ErrKeyNotExist, err)
+
+	assert.Nil(t, client.Set("run-name/slot", "true"))
+	set, err = client.CompareAndSet("run-name/slot", "true", "false")
+	assert.Nil(t, err)
+	assert.True(t, set)
+	// The second time the value doesn't match any more
+	set, err = client.CompareAndSet("run-name/slot", "true", "false")
+	assert.Nil(t, err)
+	assert.False(t, set)
+
+	value, err := client.Get("run-name/slot")
+	assert.Nil(t, err)
+	assert.Equal(t, "false", value)
+}
+
+func TestMemoryGetAndDelete(t *testing.T) {
+	client := NewMemory()
+
+	assert.Nil(t, client.Set("run-name/queued", "foo"))
+	value, err := client.GetAndDelete("run-name/queued")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", value)
+	// The second time there's nothing left
+	_, err = client.GetAndDelete("run-name/queued")
+	assert.Equal(t, ErrKeyNotExist, err)
+	_, err = client.Get("run-name/queued")
+	assert.Equal(t, ErrKeyNotExist, err)
+}
+
+func TestMemorySortedSet(t *testing.T) {
+	client := NewMemory()
+
+	assert.Nil(t, client.SortedSetAdd("runs", "c", 3))
+	assert.Nil(t, client.SortedSetAdd("runs", "a", 1))
+	assert.Nil(t, client.SortedSetAdd("runs", "b", 2))
+
+	values, err := client.SortedSetRangeAfter("runs", 1, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []ScoredValue{{Value: "b", Score: 2}, {Value: "c", Score: 3}}, values)
+	values, err = client.SortedSetRangeAfter("runs", 0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []ScoredValue{{Value: "a", Score: 1}, {Value: "b", Score: 2}}, values)
+	values, err = client.SortedSetRangeAfter("runs", 3, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []ScoredValue{}, values)
+
+	// Removing a value doesn't change where the others are
+	assert.Nil(t, client.SortedSetRemove("runs", "b"))
+	values, err = client.SortedSetRangeAfter("runs", 1, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []ScoredValue{{Value: "c", Score: 3}}, values)
+
+	// Adding a value again moves it
+	assert.Nil(t, client.SortedSetAdd("runs", "a", 4))
+	values, err = client.SortedSetRangeAfter("runs", 0, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []ScoredValue{{Value: "c", Score: 3}, {Value: "a", Score: 4}}, values)
+}
@@ -1,9 +1,30 @@
 package keyvaluestore
 
 import (
+	"strconv"
+
 	"github.com/go-redis/redis"
 )
 
+// compareAndSet sets KEYS[1] to ARGV[2] if it currently holds ARGV[1]. It's done as a
+// script so that redis runs the whole thing atomically.
+var compareAndSet = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// getAndDelete gets KEYS[1] and deletes it in one go
+var getAndDelete = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value then
+	redis.call("DEL", KEYS[1])
+end
+return value
+`)
+
 type client struct {
 	client *redis.Client
 }
@@ -18,11 +39,20 @@ func namespaced(key string) string {
 }
 
 func (client *client) Set(key string, value string) error {
-	// TODO: Do we want to set an expiration here? If so what and how does it know
-	// the correct value?
+	// There is no expiry here. The keys of a run stay around until it's deleted. If the reaper
+	// is turned on it deletes runs that have been abandoned.
 	return client.client.Set(namespaced(key), value, 0).Err()
 }
 
+func (client *client) SetIfNotExists(key string, value string) (bool, error) {
+	return client.client.SetNX(namespaced(key), value, 0).Result()
+}
+
+func (client *client) CompareAndSet(key string, old string, value string) (bool, error) {
+	result, err := compareAndSet.Run(client.client, []string{namespaced(key)}, old, value).Int()
+	return result == 1, err
+}
+
 func (client *client) Get(key string) (string, error) {
 	value, err := client.client.Get(namespaced(key)).Result()
 	if err != nil {
@@ -34,6 +64,62 @@ func (client *client) Get(key string) (string, error) {
 	return value, nil
 }
 
+func (client *client) GetAndDelete(key string) (string, error) {
+	value, err := getAndDelete.Run(client.client, []string{namespaced(key)}).String()
+	if err == redis.Nil {
+		return value, ErrKeyNotExist
+	}
+	return value, err
+}
+
 func (client *client) Delete(key string) error {
 	return client.client.Del(namespaced(key)).Err()
 }
+
+func (client *client) Increment(key string, value int64) (int64, error) {
+	return client.client.IncrBy(namespaced(key), value).Result()
+}
+
+func (client *client) ListPush(key string, value string) error {
+	return client.client.RPush(namespaced(key), value).Err()
+}
+
+func (client *client) ListPop(key string) (string, error) {
+	value, err := client.client.LPop(namespaced(key)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return value, ErrKeyNotExist
+		}
+		return value, err
+	}
+	return value, nil
+}
+
+func (client *client) ListLength(key string) (int64, error) {
+	return client.client.LLen(namespaced(key)).Result()
+}
+
+func (client *client) SortedSetAdd(key string, value string, score int64) error {
+	return client.client.ZAdd(namespaced(key), redis.Z{Score: float64(score), Member: value}).Err()
+}
+
+func (client *client) SortedSetRangeAfter(key string, after int64, count int64) ([]ScoredValue, error) {
+	// The "(" makes the minimum exclusive
+	zs, err := client.client.ZRangeByScoreWithScores(namespaced(key), redis.ZRangeBy{
+		Min:   "(" + strconv.FormatInt(after, 10),
+		Max:   "+inf",
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]ScoredValue, len(zs))
+	for i, z := range zs {
+		values[i] = ScoredValue{Value: z.Member.(string), Score: int64(z.Score)}
+	}
+	return values, nil
+}
+
+func (client *client) SortedSetRemove(key string, value string) error {
+	return client.client.ZRem(namespaced(key), value).Err()
+}
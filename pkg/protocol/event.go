@@ -18,6 +18,7 @@ func (e *Event) UnmarshalJSON(data []byte) error {
 	e.RunID = jsonEvent.RunID
 	e.ID = jsonEvent.ID
 	e.Time = jsonEvent.Time
+	e.Labels = jsonEvent.Labels
 	switch jsonEvent.Type {
 	case "start":
 		var d StartData
@@ -39,6 +40,10 @@ func (e *Event) UnmarshalJSON(data []byte) error {
 		var d LastData
 		err = json.Unmarshal(*jsonEvent.Data, &d)
 		e.Data = d
+	case "queued":
+		var d QueuedData
+		err = json.Unmarshal(*jsonEvent.Data, &d)
+		e.Data = d
 	default:
 		return errors.New("unexpected type")
 	}
@@ -69,3 +74,13 @@ func NewFirstEvent(id string, runID string, time time.Time) Event {
 func NewLastEvent(id string, runID string, time time.Time) Event {
 	return Event{ID: id, RunID: runID, Time: time, Type: "last", Data: LastData{}}
 }
+
+// NewQueuedEvent creates and returns a new queued event
+func NewQueuedEvent(id string, runID string, time time.Time) Event {
+	return Event{ID: id, RunID: runID, Time: time, Type: "queued", Data: QueuedData{}}
+}
+
+// NewLastEventWithReason creates and returns a new last event for a run that didn't finish normally
+func NewLastEventWithReason(id string, runID string, time time.Time, reason string) Event {
+	return Event{ID: id, RunID: runID, Time: time, Type: "last", Data: LastData{Reason: reason}}
+}
@@ -63,6 +63,24 @@ func TestMarshalLastEvent(t *testing.T) {
 	)
 }
 
+func TestMarshalQueuedEvent(t *testing.T) {
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	testMarshal(t,
+		NewQueuedEvent("", "abc", time),
+		`{"run_id":"abc","time":"2000-01-02T03:45:00Z","type":"queued","data":{}}`,
+	)
+}
+
+func TestMarshalEventWithLabels(t *testing.T) {
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+	event := NewFirstEvent("", "abc", time)
+	event.Labels = map[string]string{"scraper": "planningalerts"}
+	testMarshal(t,
+		event,
+		`{"run_id":"abc","time":"2000-01-02T03:45:00Z","type":"first","data":{},"labels":{"scraper":"planningalerts"}}`,
+	)
+}
+
 func TestNewLogEvent(t *testing.T) {
 	now := time.Now()
 	assert.Equal(t,
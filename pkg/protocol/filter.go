@@ -0,0 +1,32 @@
+package protocol
+
+// EventFilter picks out which events are wanted. An empty list matches everything.
+// Stages and Streams only apply to log events. Other events are matched by Types alone.
+type EventFilter struct {
+	Types   []string
+	Stages  []string
+	Streams []string
+}
+
+// Matches checks whether an event gets through the filter
+func (filter EventFilter) Matches(e Event) bool {
+	if !matchesAny(filter.Types, e.Type) {
+		return false
+	}
+	if l, ok := e.Data.(LogData); ok {
+		return matchesAny(filter.Stages, l.Stage) && matchesAny(filter.Streams, l.Stream)
+	}
+	return true
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
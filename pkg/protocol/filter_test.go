@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilterMatches(t *testing.T) {
+	time := time.Now()
+	log := NewLogEvent("", "abc", time, "build", "stderr", "Oops")
+	finish := NewFinishEvent("", "abc", time, "build", ExitDataStage{})
+
+	assert.True(t, EventFilter{}.Matches(log))
+	assert.True(t, EventFilter{Types: []string{"finish", "log"}}.Matches(log))
+	assert.False(t, EventFilter{Types: []string{"finish", "last"}}.Matches(log))
+	assert.True(t, EventFilter{Stages: []string{"build"}}.Matches(log))
+	assert.False(t, EventFilter{Stages: []string{"execute"}}.Matches(log))
+	assert.True(t, EventFilter{Streams: []string{"stdout", "stderr"}}.Matches(log))
+	assert.False(t, EventFilter{Streams: []string{"stdout"}}.Matches(log))
+	assert.False(t, EventFilter{Stages: []string{"build"}, Streams: []string{"stdout"}}.Matches(log))
+	// Stages and streams only apply to log events
+	assert.True(t, EventFilter{Stages: []string{"execute"}, Streams: []string{"stdout"}}.Matches(finish))
+}
@@ -8,8 +8,13 @@ import (
 // All the types here are used in the yinyo API. So, they all will get serialised and deserialised.
 // Therefore, for all types include an explicit instruction for JSON marshalling/unmarshalling.
 
+// CreateRunOptions are options that can be used when creating a run. The API key is passed
+// as a query parameter rather than in the body.
 type CreateRunOptions struct {
-	APIKey string
+	APIKey string `json:"-"`
+	// Labels are arbitrary keys and values that are kept with the run. They follow the same
+	// rules as Kubernetes labels.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // StartRunOptions are options that can be used when starting a run
@@ -19,6 +24,15 @@ type StartRunOptions struct {
 	Env        []EnvVariable `json:"env"`
 	MaxRunTime int64         `json:"max_run_time"`
 	Memory     int64         `json:"memory"`
+	CPU        int64         `json:"cpu"` // In millicores
+	Scheduling Scheduling    `json:"scheduling"`
+}
+
+// Scheduling is where and how a run should be run. What can be chosen here is restricted
+// by how the server is configured
+type Scheduling struct {
+	NodeSelector  map[string]string `json:"node_selector,omitempty"`
+	PriorityClass string            `json:"priority_class,omitempty"`
 }
 
 // Callback represents what we need to know to make a particular callback request
@@ -39,6 +53,8 @@ type ExitData struct {
 	Build    *ExitDataStage `json:"build,omitempty"`
 	Execute  *ExitDataStage `json:"execute,omitempty"`
 	Finished bool           `json:"finished"`
+	// Reason is only set if the run didn't finish normally
+	Reason string `json:"reason,omitempty"`
 }
 
 // ExitDataStage gives the exit data for a single stage
@@ -59,22 +75,79 @@ type Run struct {
 	ID string `json:"id"`
 }
 
+// RunStatus is the current state of a run. State is one of "created" (the run hasn't been started
+// yet), "queued", "pending", "running", "succeeded", "failed", "deadline_exceeded", "cancelled" or
+// "finished" (the run finished but its job has gone). Restarts is the number of times the run was
+// restarted after a failure.
+type RunStatus struct {
+	State    string            `json:"state"`
+	Restarts int32             `json:"restarts"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// EventsPage is a page of events that is returned when not following the events. Cursor is
+// the id to carry on from to get the next page. More is true when the page was cut short by
+// the limit on the number of events.
+type EventsPage struct {
+	Events []Event `json:"events"`
+	Cursor string  `json:"cursor"`
+	More   bool    `json:"more"`
+}
+
+// RunSummary is what is returned about each run when listing runs. Phase is how far the run has
+// got and is one of "created", "app_uploaded", "started", "finished" or "deleting". It's not the
+// same as the State in RunStatus which comes from the job that is doing the run.
+type RunSummary struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Phase     string            `json:"phase"`
+	ExitData  ExitData          `json:"exit_data"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// RunsPage is a page of runs. Cursor is where to carry on from to get the next page. More is
+// true when the page was cut short by the limit on the number of runs.
+type RunsPage struct {
+	Runs   []RunSummary `json:"runs"`
+	Cursor string       `json:"cursor"`
+	More   bool         `json:"more"`
+}
+
+// ControlMessage is sent by a client over the websocket for a run. Type is one of "cancel",
+// "status" or "subscribe". When subscribing, Types are the types of events to send. If it's
+// empty all events are sent.
+type ControlMessage struct {
+	Type  string   `json:"type"`
+	Types []string `json:"types,omitempty"`
+}
+
+// ControlResponse is sent back over the websocket in reply to a ControlMessage. Type is one
+// of "cancelled", "status", "subscribed" or "error".
+type ControlResponse struct {
+	Type   string     `json:"type"`
+	Status *RunStatus `json:"status,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
 // JSONEvent is used for reading JSON
 type JSONEvent struct {
-	ID    string           `json:"id"`
-	RunID string           `json:"run_id"`
-	Time  time.Time        `json:"time"`
-	Type  string           `json:"type"`
-	Data  *json.RawMessage `json:"data"`
+	ID     string            `json:"id"`
+	RunID  string            `json:"run_id"`
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"`
+	Data   *json.RawMessage  `json:"data"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
-// Event is the top level struct for representing events
+// Event is the top level struct for representing events. Labels are the labels of the run
+// and are only included in events that are sent to the callback URL.
 type Event struct {
-	ID    string    `json:"id,omitempty"`
-	RunID string    `json:"run_id"`
-	Time  time.Time `json:"time"`
-	Type  string    `json:"type"`
-	Data  Data      `json:"data"`
+	ID     string            `json:"id,omitempty"`
+	RunID  string            `json:"run_id"`
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"`
+	Data   Data              `json:"data"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // Data is the interface for all core event data
@@ -103,8 +176,14 @@ type LogData struct {
 type FirstData struct {
 }
 
-// LastData is the last event that's sent in a run
+// LastData is the last event that's sent in a run. Reason is only set if the run didn't finish
+// normally. For instance, if it ran out of time.
 type LastData struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// QueuedData is sent when a run has to wait for other runs to finish before it can start
+type QueuedData struct {
 }
 
 // Hello gives some basic useful information about the server
@@ -112,6 +191,7 @@ type Hello struct {
 	Message     string        `json:"message"`
 	MaxRunTime  DefaultAndMax `json:"max_run_time"`
 	Memory      DefaultAndMax `json:"memory"`
+	CPU         DefaultAndMax `json:"cpu"`
 	Version     string        `json:"version"`
 	RunnerImage string        `json:"runner_image"`
 }
@@ -1,6 +1,11 @@
 package stream
 
-import "github.com/openaustralia/yinyo/pkg/protocol"
+import (
+	"context"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
 
 // This is a distributed stream: something where we can add events to a key
 // and those events can be streamed from one or more other places
@@ -9,6 +14,12 @@ import "github.com/openaustralia/yinyo/pkg/protocol"
 // Stream is the interface for accessing the distributed stream
 type Stream interface {
 	Add(key string, event protocol.Event) (addedEvent protocol.Event, err error)
-	Get(key string, id string) (event protocol.Event, err error)
+	// Get returns up to count of the events after id. If there aren't any yet it waits until there
+	// is at least one. It gives up with the context's error when ctx is done.
+	Get(ctx context.Context, key string, id string, count int64) (events []protocol.Event, err error)
+	// LastID returns the id of the most recent event or "" if there aren't any
+	LastID(key string) (string, error)
 	Delete(key string) error
+	// Expire deletes the stream once the given time has passed
+	Expire(key string, after time.Duration) error
 }
@@ -0,0 +1,32 @@
+package stream
+
+import "fmt"
+
+// ID is the id of an event in a stream. It has the same form as a redis stream ID:
+// <milliseconds>-<sequence number>
+type ID struct {
+	Time     int64
+	Sequence int64
+}
+
+// ParseID parses the string form of an ID. A bare number (like "0") is also a valid ID.
+func ParseID(id string) (ID, error) {
+	var i ID
+	_, err := fmt.Sscanf(id, "%d-%d", &i.Time, &i.Sequence)
+	if err != nil {
+		_, err = fmt.Sscanf(id, "%d", &i.Time)
+	}
+	if err != nil {
+		return i, fmt.Errorf("invalid event id %q", id)
+	}
+	return i, nil
+}
+
+func (id ID) String() string {
+	return fmt.Sprintf("%d-%d", id.Time, id.Sequence)
+}
+
+// After returns true if id comes after other in a stream
+func (id ID) After(other ID) bool {
+	return id.Time > other.Time || (id.Time == other.Time && id.Sequence > other.Sequence)
+}
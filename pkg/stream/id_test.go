@@ -0,0 +1,25 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseID(t *testing.T) {
+	id, err := ParseID("0")
+	assert.Nil(t, err)
+	assert.Equal(t, ID{}, id)
+	id, err = ParseID("1583900670123-2")
+	assert.Nil(t, err)
+	assert.Equal(t, ID{Time: 1583900670123, Sequence: 2}, id)
+	assert.Equal(t, "1583900670123-2", id.String())
+	_, err = ParseID("foo")
+	assert.NotNil(t, err)
+}
+
+func TestIDAfter(t *testing.T) {
+	assert.True(t, ID{Time: 2}.After(ID{Time: 1, Sequence: 5}))
+	assert.True(t, ID{Time: 1, Sequence: 2}.After(ID{Time: 1, Sequence: 1}))
+	assert.False(t, ID{Time: 1, Sequence: 1}.After(ID{Time: 1, Sequence: 1}))
+}
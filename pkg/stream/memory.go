@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+)
+
+type memoryStream struct {
+	mutex   sync.Mutex
+	added   *sync.Cond
+	streams map[string][]protocol.Event
+	last    ID
+}
+
+// NewMemory returns an implementation of Stream that keeps everything in memory. It
+// only works when there is a single server and everything is lost when it restarts so
+// it's only really useful for development and testing.
+func NewMemory() Stream {
+	stream := &memoryStream{streams: make(map[string][]protocol.Event)}
+	stream.added = sync.NewCond(&stream.mutex)
+	return stream
+}
+
+func (stream *memoryStream) Add(key string, event protocol.Event) (addedEvent protocol.Event, err error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	// Generate an ID in the same way that redis does. It always increases.
+	id := ID{Time: time.Now().UnixNano() / int64(time.Millisecond)}
+	if !id.After(stream.last) {
+		id = ID{Time: stream.last.Time, Sequence: stream.last.Sequence + 1}
+	}
+	stream.last = id
+
+	addedEvent = event
+	// Add the id to the returned event
+	addedEvent.ID = id.String()
+	stream.streams[key] = append(stream.streams[key], addedEvent)
+	stream.added.Broadcast()
+	return
+}
+
+// Get the next events in the stream after the id. It will wait until there's
+// at least one available or ctx is done
+func (stream *memoryStream) Get(ctx context.Context, key string, id string, count int64) (events []protocol.Event, err error) {
+	after, err := ParseID(id)
+	if err != nil {
+		return
+	}
+
+	// Wake up the waiting below if ctx is done first
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.mutex.Lock()
+			stream.added.Broadcast()
+			stream.mutex.Unlock()
+		case <-finished:
+		}
+	}()
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		for _, e := range stream.streams[key] {
+			// We can ignore the error because we generated the ID
+			eventID, _ := ParseID(e.ID)
+			if eventID.After(after) {
+				events = append(events, e)
+				if int64(len(events)) == count {
+					break
+				}
+			}
+		}
+		if len(events) > 0 {
+			return
+		}
+		stream.added.Wait()
+	}
+}
+
+func (stream *memoryStream) LastID(key string) (string, error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	events := stream.streams[key]
+	if len(events) == 0 {
+		return "", nil
+	}
+	return events[len(events)-1].ID, nil
+}
+
+func (stream *memoryStream) Delete(key string) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	delete(stream.streams, key)
+	return nil
+}
+
+func (stream *memoryStream) Expire(key string, after time.Duration) error {
+	time.AfterFunc(after, func() {
+		//nolint:errcheck // deleting from memory can't fail
+		//skipcq: GSC-G104
+		stream.Delete(key)
+	})
+	return nil
+}
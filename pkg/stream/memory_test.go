@@ -0,0 +1,99 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openaustralia/yinyo/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAddAndGet(t *testing.T) {
+	stream := NewMemory()
+	time := time.Date(2000, time.January, 2, 3, 45, 0, 0, time.UTC)
+
+	e1, err := stream.Add("run-name", protocol.NewStartEvent("", "abc", time, "build"))
+	assert.Nil(t, err)
+	e2, err := stream.Add("run-name", protocol.NewLastEvent("", "abc", time))
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", e1.ID)
+	assert.NotEqual(t, e1.ID, e2.ID)
+
+	e, err := stream.Get(context.Background(), "run-name", "0", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []protocol.Event{protocol.NewStartEvent(e1.ID, "abc", time, "build")}, e)
+	e, err = stream.Get(context.Background(), "run-name", e1.ID, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []protocol.Event{protocol.NewLastEvent(e2.ID, "abc", time)}, e)
+	e, err = stream.Get(context.Background(), "run-name", "0", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []protocol.Event{
+		protocol.NewStartEvent(e1.ID, "abc", time, "build"),
+		protocol.NewLastEvent(e2.ID, "abc", time),
+	}, e)
+}
+
+func TestMemoryGetWaits(t *testing.T) {
+	stream := NewMemory()
+	time := time.Now()
+
+	got := make(chan []protocol.Event)
+	go func() {
+		e, _ := stream.Get(context.Background(), "run-name", "0", 10)
+		got <- e
+	}()
+	added, err := stream.Add("run-name", protocol.NewLastEvent("", "abc", time))
+	assert.Nil(t, err)
+	assert.Equal(t, []protocol.Event{added}, <-got)
+}
+
+func TestMemoryGetCancelled(t *testing.T) {
+	stream := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	got := make(chan error)
+	go func() {
+		_, err := stream.Get(ctx, "run-name", "0", 10)
+		got <- err
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-got)
+}
+
+func TestMemoryLastID(t *testing.T) {
+	stream := NewMemory()
+
+	id, err := stream.LastID("run-name")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+	stream.Add("run-name", protocol.NewStartEvent("", "abc", time.Now(), "build"))
+	e, _ := stream.Add("run-name", protocol.NewLastEvent("", "abc", time.Now()))
+	id, err = stream.LastID("run-name")
+	assert.Nil(t, err)
+	assert.Equal(t, e.ID, id)
+}
+
+func TestMemoryDelete(t *testing.T) {
+	stream := NewMemory().(*memoryStream)
+
+	_, err := stream.Add("run-name", protocol.NewLastEvent("", "abc", time.Now()))
+	assert.Nil(t, err)
+	err = stream.Delete("run-name")
+	assert.Nil(t, err)
+	assert.Empty(t, stream.streams)
+}
+
+func TestMemoryExpire(t *testing.T) {
+	stream := NewMemory().(*memoryStream)
+
+	_, err := stream.Add("run-name", protocol.NewLastEvent("", "abc", time.Now()))
+	assert.Nil(t, err)
+	err = stream.Expire("run-name", 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		stream.mutex.Lock()
+		defer stream.mutex.Unlock()
+		return len(stream.streams) == 0
+	}, time.Second, time.Millisecond)
+}
@@ -1,12 +1,18 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/openaustralia/yinyo/pkg/protocol"
 )
 
+// The longest that a single read blocks for. Between reads we check whether whoever is
+// waiting has given up so that the connection can be released.
+const redisBlockTimeout = 5 * time.Second
+
 type redisStream struct {
 	client *redis.Client
 }
@@ -34,28 +40,55 @@ func (stream *redisStream) Add(key string, event protocol.Event) (addedEvent pro
 	return
 }
 
-// Get the next event in the stream based on the id. It will wait until it's
-// available
-func (stream *redisStream) Get(key string, id string) (event protocol.Event, err error) {
-	// For the moment get one event at a time
-	// TODO: Grab more than one at a time for a little more efficiency
-	result, err := stream.client.XRead(&redis.XReadArgs{
-		Streams: []string{key, id},
-		Count:   1,
-		Block:   0,
-	}).Result()
-	if err != nil {
-		return
+// Get the next events in the stream after the id. It will wait until there's
+// at least one available or ctx is done
+func (stream *redisStream) Get(ctx context.Context, key string, id string, count int64) (events []protocol.Event, err error) {
+	var result []redis.XStream
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		result, err = stream.client.XRead(&redis.XReadArgs{
+			Streams: []string{key, id},
+			Count:   count,
+			Block:   redisBlockTimeout,
+		}).Result()
+		// Nothing arrived before the timeout
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		break
+	}
+	for _, message := range result[0].Messages {
+		var event protocol.Event
+		jsonString := message.Values["json"].(string)
+		err = json.Unmarshal([]byte(jsonString), &event)
+		if err != nil {
+			return
+		}
+		// Add the id to the event
+		event.ID = message.ID
+		events = append(events, event)
 	}
-	newID := result[0].Messages[0].ID
-	jsonString := result[0].Messages[0].Values["json"].(string)
-
-	err = json.Unmarshal([]byte(jsonString), &event)
-	// Add the id to the event
-	event.ID = newID
 	return
 }
 
+func (stream *redisStream) LastID(key string) (string, error) {
+	messages, err := stream.client.XRevRangeN(key, "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "", err
+	}
+	return messages[0].ID, nil
+}
+
 func (stream *redisStream) Delete(key string) error {
 	return stream.client.Del(key).Err()
 }
+
+func (stream *redisStream) Expire(key string, after time.Duration) error {
+	return stream.client.Expire(key, after).Err()
+}
@@ -137,7 +137,7 @@ func runScraper(appDirectory, cachePath string, env []protocol.EnvVariable) ([]p
 	}
 
 	// Get the logs (events)
-	iterator, err := run.GetEvents("")
+	iterator, err := run.GetEvents("", protocol.EventFilter{})
 	if err != nil {
 		return eventsList, err
 	}